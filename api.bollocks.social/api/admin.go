@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const RoleAdmin = "admin"
+
+// Account holds what the service knows about a user beyond their token.
+type Account struct {
+	Roles     []string   `json:"roles"`
+	Banned    bool       `json:"banned"`
+	BannedAt  *time.Time `json:"banned_at,omitempty"`
+	BanReason string     `json:"ban_reason,omitempty"`
+}
+
+// ModeratedPost is a post withheld from the feed, with the detail needed to review it.
+type ModeratedPost struct {
+	Post
+	Author      string      `json:"author"`
+	Hidden      bool        `json:"hidden"`
+	ReportCount int         `json:"report_count"`
+	Moderation  *Moderation `json:"moderation,omitempty"`
+}
+
+// LoadAccount adds roles from the local roles store to those granted by token claims,
+// and rejects users who have been banned. It must run after VerifyToken.
+// Health checks are passed through without loading the account, so probes do not read the store.
+func LoadAccount(logger log.Logger, s Service) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := ContextGetUserId(r.Context())
+			if !ok || r.URL.Path == "/health" || r.URL.Path == "/ready" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			account, err := s.GetAccount(r.Context(), userID)
+			if err != nil {
+				logger.Log("failed to get account", "error", err, "user_id", userID)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if account.Banned {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			roles := slices.Concat(ContextGetRoles(r.Context()), account.Roles)
+			slices.Sort(roles)
+			ctx := ContextWithRoles(r.Context(), slices.Compact(roles))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireRole rejects requests from users without role.
+func RequireRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ContextHasRole(r.Context(), role) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewAdminHandler returns the /admin route group. Callers must restrict it to admins.
+func NewAdminHandler(logger log.Logger, s Service) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /admin/posts/{postId}", AdminDeletePost(logger, s))
+	mux.HandleFunc("POST /admin/posts/{postId}/restore", RestoreReportedPost(logger, s))
+	mux.HandleFunc("GET /admin/moderation", ListModeratedPosts(logger, s))
+	mux.HandleFunc("GET /admin/reports", ListReports(logger, s))
+	mux.HandleFunc("POST /admin/reports/{reportId}/resolve", ResolveReport(logger, s))
+	mux.HandleFunc("PUT /admin/users/{userId}/ban", BanUser(logger, s))
+	mux.HandleFunc("DELETE /admin/users/{userId}/ban", UnbanUser(logger, s))
+	mux.HandleFunc("POST /admin/webhooks", CreateWebhook(logger, s, true))
+	mux.HandleFunc("GET /admin/webhooks", ListWebhooks(logger, s, true))
+	mux.HandleFunc("GET /admin/metrics", Metrics)
+	return mux
+}
+
+// DELETE /admin/posts/{postId}
+func AdminDeletePost(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID := r.PathValue("postId")
+		if err := s.AdminDeletePost(r.Context(), postID); err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			case status.Code(err) == codes.Aborted:
+				w.WriteHeader(http.StatusConflict)
+			default:
+				logger.Log("failed to delete post", "error", err, "post_id", postID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /admin/moderation
+func ListModeratedPosts(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		posts, err := s.ListModeratedPosts(r.Context())
+		if err != nil {
+			logger.Log("failed to list moderated posts", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(posts)
+	}
+}
+
+// PUT /admin/users/{userId}/ban
+func BanUser(logger log.Logger, s Service) http.HandlerFunc {
+	type request struct {
+		Reason string `json:"reason"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userID := r.PathValue("userId")
+		account, err := s.BanUser(r.Context(), userID, req.Reason)
+		if err != nil {
+			logger.Log("failed to ban user", "error", err, "user_id", userID)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(account)
+	}
+}
+
+// DELETE /admin/users/{userId}/ban
+func UnbanUser(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("userId")
+		if err := s.UnbanUser(r.Context(), userID); err != nil {
+			logger.Log("failed to unban user", "error", err, "user_id", userID)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
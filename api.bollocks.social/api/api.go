@@ -3,34 +3,131 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"net/http"
 
-	"github.com/mchipperfield/bollocks/api.bollocks.social/genai"
 	"github.com/mchipperfield/gocore/log"
 )
 
 type Service interface {
 	GetFeed(ctx context.Context) ([]Post, error)
-	CreatePost(ctx context.Context, bollocks string, tags []string) (*Post, error)
+	WatchFeed(ctx context.Context, sub Subscription, events chan<- FeedEvent) error
+	CreatePost(ctx context.Context, content PostContent) (*Post, error)
 	GetPosts(ctx context.Context) ([]Post, error)
+	GetPost(ctx context.Context, postID string) (*Post, error)
 	DeletePost(ctx context.Context, postID string) error
-	UpdatePost(ctx context.Context, postID, bollocks string, tags []string) (*Post, error)
+	RestorePost(ctx context.Context, postID string) (*Post, error)
+	ListDrafts(ctx context.Context) ([]Post, error)
+	PublishPost(ctx context.Context, postID string) (*Post, error)
+	UpdatePost(ctx context.Context, postID, version string, content PostContent) (*Post, error)
+	ListRevisions(ctx context.Context, postID string) ([]Revision, error)
 	ToggleLike(ctx context.Context, postID string) (*Post, error)
+	LikePost(ctx context.Context, postID string) (*Post, error)
+	UnlikePost(ctx context.Context, postID string) (*Post, error)
+	ListLikes(ctx context.Context, postID, cursor string, limit int) (*LikesPage, error)
 	GetMyProfile(ctx context.Context) (*Profile, error)
-	UpdateMyProfile(ctx context.Context, interests []string) (*Profile, error)
+	UpdateMyProfile(ctx context.Context, update ProfileUpdate) (*Profile, error)
+	ReportPost(ctx context.Context, postID, reason, details string) (*Report, error)
+	ListReports(ctx context.Context, status string) ([]Report, error)
+	ResolveReport(ctx context.Context, reportID, action string) (*Report, error)
+	RestoreReportedPost(ctx context.Context, postID string) error
+	GetAccount(ctx context.Context, userID string) (*Account, error)
+	BanUser(ctx context.Context, userID, reason string) (*Account, error)
+	UnbanUser(ctx context.Context, userID string) error
+	AdminDeletePost(ctx context.Context, postID string) error
+	ListModeratedPosts(ctx context.Context) ([]ModeratedPost, error)
+	BlockUser(ctx context.Context, userID string) error
+	UnblockUser(ctx context.Context, userID string) error
+	MuteUser(ctx context.Context, userID string) error
+	UnmuteUser(ctx context.Context, userID string) error
+	ListNotifications(ctx context.Context, cursor string, limit int) (*NotificationsPage, error)
+	MarkNotificationRead(ctx context.Context, notificationID string) error
+	MarkAllNotificationsRead(ctx context.Context) error
+	CreateWebhook(ctx context.Context, in WebhookInput, global bool) (*Webhook, error)
+	ListWebhooks(ctx context.Context, global bool) ([]Webhook, error)
+	DeleteWebhook(ctx context.Context, webhookID string) error
+	ListWebhookDeliveries(ctx context.Context, webhookID, status string) ([]WebhookDelivery, error)
+	GetWebhookDelivery(ctx context.Context, webhookID, deliveryID string) (*WebhookDelivery, error)
 }
 
-func NewHandler(logger log.Logger, s Service, ai *genai.Service) *http.ServeMux {
+// Tagger generates tags for the content of a post.
+type Tagger interface {
+	GenerateTags(ctx context.Context, content string) ([]string, error)
+}
+
+// TagQueue generates tags for a post in the background once it has been stored.
+type TagQueue interface {
+	Enqueue(postID, content string) bool
+}
+
+// HealthCheck reports the status of a dependency as "pass", "warn" or "fail" along with a short description.
+type HealthCheck func(ctx context.Context) (status string, output string)
+
+// Deps are what the API routes are served by. Service and Tagger are required, the others may be left nil.
+type Deps struct {
+	Service Service
+	Tagger  Tagger
+	// TagQueue generates tags in the background, if nil they are generated synchronously when a post is written.
+	TagQueue TagQueue
+	// Moderator checks posts as they are written, if nil posts are not moderated.
+	Moderator Moderator
+	// Media stores uploads, if nil files cannot be attached to posts.
+	Media Media
+	// Previewer fetches previews of links in posts, if nil they are not previewed.
+	Previewer Previewer
+	// Hub fans out live updates, if nil they are not served over feed streams or websockets.
+	Hub    Hub
+	Stream StreamConfig
+	// Checks are the dependencies reported on by the readiness endpoint.
+	Checks map[string]HealthCheck
+}
+
+// NewHandler returns the API routes, served by deps.
+func NewHandler(logger log.Logger, deps Deps) *http.ServeMux {
+	s, ai, tagQueue, moderator := deps.Service, deps.Tagger, deps.TagQueue, deps.Moderator
+	media, previewer, hub, stream, checks := deps.Media, deps.Previewer, deps.Hub, deps.Stream, deps.Checks
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /health", Health)
+	mux.HandleFunc("GET /ready", Ready(checks))
 	mux.HandleFunc("GET /feed", GetFeed(logger, s))
-	mux.HandleFunc("POST /posts", CreatePost(logger, s, ai))
+	mux.HandleFunc("POST /posts", CreatePost(logger, s, ai, tagQueue, moderator, media, previewer))
 	mux.HandleFunc("GET /posts", GetPosts(logger, s))
-	mux.HandleFunc("PATCH /posts/{postId}", UpdatePost(logger, s, ai))
+	mux.HandleFunc("GET /posts/{postId}", GetPost(logger, s))
+	mux.HandleFunc("PATCH /posts/{postId}", UpdatePost(logger, s, ai, tagQueue, moderator, media, previewer))
 	mux.HandleFunc("DELETE /posts/{postId}", DeletePost(logger, s))
-	mux.HandleFunc("POST /posts/{postId}/likes", LikePost(logger, s))
+	mux.HandleFunc("POST /posts/{postId}/restore", RestorePost(logger, s))
+	mux.HandleFunc("GET /drafts", ListDrafts(logger, s))
+	mux.HandleFunc("POST /drafts", CreateDraft(logger, s, ai, tagQueue, moderator, media, previewer))
+	mux.HandleFunc("POST /drafts/{postId}/publish", PublishPost(logger, s))
+	mux.HandleFunc("GET /posts/{postId}/revisions", ListRevisions(logger, s))
+	mux.HandleFunc("POST /posts/{postId}/likes", ToggleLike(logger, s))
+	mux.HandleFunc("GET /posts/{postId}/likes", ListLikes(logger, s))
+	mux.HandleFunc("PUT /posts/{postId}/likes/me", LikePost(logger, s))
+	mux.HandleFunc("DELETE /posts/{postId}/likes/me", UnlikePost(logger, s))
+	mux.HandleFunc("POST /posts/{postId}/reports", ReportPost(logger, s))
 	mux.HandleFunc("GET /profiles/me", GetMyProfile(logger, s))
 	mux.HandleFunc("PATCH /profiles/me", UpdateMyProfile(logger, s))
+	mux.HandleFunc("POST /users/{userId}/block", BlockUser(logger, s))
+	mux.HandleFunc("DELETE /users/{userId}/block", UnblockUser(logger, s))
+	mux.HandleFunc("POST /users/{userId}/mute", MuteUser(logger, s))
+	mux.HandleFunc("DELETE /users/{userId}/mute", UnmuteUser(logger, s))
+	mux.HandleFunc("GET /notifications", ListNotifications(logger, s))
+	mux.HandleFunc("POST /notifications/read", MarkAllNotificationsRead(logger, s))
+	mux.HandleFunc("POST /notifications/{notificationId}/read", MarkNotificationRead(logger, s))
+	mux.HandleFunc("POST /webhooks", CreateWebhook(logger, s, false))
+	mux.HandleFunc("GET /webhooks", ListWebhooks(logger, s, false))
+	mux.HandleFunc("DELETE /webhooks/{webhookId}", DeleteWebhook(logger, s))
+	mux.HandleFunc("GET /webhooks/{webhookId}/deliveries", ListWebhookDeliveries(logger, s))
+	mux.HandleFunc("GET /webhooks/{webhookId}/deliveries/{deliveryId}", GetWebhookDelivery(logger, s))
+	if media != nil {
+		mux.HandleFunc("POST /uploads", CreateUpload(logger, media))
+		mux.HandleFunc("PUT /uploads/{uploadId}", PutUpload(logger, media))
+	}
+	if hub != nil {
+		mux.HandleFunc("GET /feed/stream", StreamFeed(logger, s, hub, stream))
+		mux.HandleFunc("GET /ws", WebSocket(logger, s, hub, stream))
+	}
+	mux.Handle("/admin/", RequireRole(RoleAdmin)(NewAdminHandler(logger, s)))
 	return mux
 }
 
@@ -66,3 +163,56 @@ func Health(w http.ResponseWriter, r *http.Request) {
 		"description": "health check endpoint for the bollocks.social API",
 	})
 }
+
+// Ready reports whether the service and its dependencies are ready to serve traffic.
+// Any failing check fails readiness, warnings are reported but still ready.
+func Ready(checks map[string]HealthCheck) http.HandlerFunc {
+	type check struct {
+		Status string `json:"status"`
+		Output string `json:"output,omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		overall := "pass"
+		results := make(map[string][]check, len(checks))
+		for name, fn := range checks {
+			status, output := fn(r.Context())
+			results[name] = []check{{Status: status, Output: output}}
+			switch {
+			case status == "fail":
+				overall = "fail"
+			case status == "warn" && overall == "pass":
+				overall = "warn"
+			}
+		}
+
+		code := http.StatusOK
+		if overall == "fail" {
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/health+json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":    overall,
+			"serviceId": "https://api.bollocks.social",
+			"checks":    results,
+		})
+	}
+}
+
+// GET /admin/metrics
+// Metrics serves the service's own expvar maps. Variables published by expvar itself are not served,
+// as the process's command line and memory statistics are not for clients.
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	metrics := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if m, ok := kv.Value.(*expvar.Map); ok {
+			metrics[kv.Key] = json.RawMessage(m.String())
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(metrics)
+}
@@ -10,10 +10,8 @@ import (
 func VerifyToken(c *auth.Client) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			h := r.Header.Get("Authorization")
-
-			accessToken, ok := strings.CutPrefix(h, "Bearer ")
-			if !ok || accessToken == "" {
+			accessToken := bearerToken(r)
+			if accessToken == "" {
 				w.Header().Set("WWW-Authenticate", `Bearer realm="api.bollocks.social" error="invalid_request" error_description="missing parameter: access_token"`)
 				w.WriteHeader(http.StatusUnauthorized)
 				return
@@ -29,7 +27,42 @@ func VerifyToken(c *auth.Client) func(next http.Handler) http.Handler {
 			}
 
 			ctx := ContextWithUserId(r.Context(), token.Subject)
+			ctx = ContextWithRoles(ctx, claimedRoles(token.Claims))
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// bearerToken returns the token in the Authorization header, or for WebSocket handshakes, which
+// browsers cannot add headers to, the token offered as a "bearer.<token>" subprotocol.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return ""
+	}
+	for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), "bearer."); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// claimedRoles returns the roles granted by Firebase custom claims, either as a "roles" list
+// or a boolean claim named after the role, e.g. {"admin": true}.
+func claimedRoles(claims map[string]any) []string {
+	var roles []string
+	if list, ok := claims["roles"].([]any); ok {
+		for _, v := range list {
+			if role, ok := v.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	if admin, _ := claims[RoleAdmin].(bool); admin {
+		roles = append(roles, RoleAdmin)
+	}
+	return roles
+}
@@ -1,24 +1,105 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/mchipperfield/bollocks/api.bollocks.social/genai"
 	"github.com/mchipperfield/gocore/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 // Post defines the structure of a post as returned by the API.
-// Specifically, it does not include the author field as this should not be exposed to the client.
+// Specifically, it does not include the author's user ID as this should not be exposed to the client,
+// only their public profile summary unless the post is anonymous.
 type Post struct {
-	ID        string    `json:"id"`
-	Bollocks  string    `json:"bollocks"`
-	Tags      []string  `json:"tags"`
+	ID       string   `json:"id"`
+	Bollocks string   `json:"bollocks"`
+	Tags     []string `json:"tags"`
+	// Attachments is empty for text-only posts.
+	Attachments  []Attachment  `json:"attachments"`
+	LinkPreviews []LinkPreview `json:"link_previews,omitempty"`
+	// Entities is empty for posts written before entities were extracted.
+	Entities []Entity `json:"entities"`
+	// TagsStatus is pending while AI tags are generated in the background, the tags
+	// hold those derived from hashtags until then.
+	TagsStatus string `json:"tags_status,omitempty"`
+	// Status is draft or scheduled until the post is published, PublishAt is when a scheduled post is due.
+	Status    string     `json:"status"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// CreatedAt is when the post was published, or written while it is unpublished.
+	// UpdatedAt is when its content or tags last changed.
 	CreatedAt time.Time `json:"created_at"`
-	Likes     int       `json:"likes"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Edited is set once the author has changed the content of the post, EditedAt is when they last did.
+	Edited   bool       `json:"edited"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	Likes    int        `json:"likes"`
+	// ModerationStatus is only set on the author's own posts, so they can see when a post was quarantined.
+	ModerationStatus string `json:"moderation_status,omitempty"`
+	// Author is nil for anonymous posts and authors without a public profile.
+	Author    *Author `json:"author,omitempty"`
+	Anonymous bool    `json:"anonymous"`
+	IsMine    bool    `json:"is_mine"`
+	LikedByMe bool    `json:"liked_by_me"`
+	// Version changes whenever the author edits, publishes, deletes or restores the post, for optimistic
+	// concurrency. Tags generated in the background do not change it. It is sent as the ETag header rather than in the body.
+	Version string `json:"-"`
+}
+
+// Author is the public summary of a post's author.
+type Author struct {
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// PostContent is what is written to a post when it is created or updated.
+type PostContent struct {
+	Bollocks   string
+	Tags       []string
+	TagsStatus string
+	// Moderation is nil when moderation is disabled.
+	Moderation *Moderation
+	// Attachments replace those of an updated post, unless nil when they are left unchanged.
+	Attachments  []Attachment
+	LinkPreviews []LinkPreview
+	Entities     []Entity
+	// Anonymous hides the author's profile from other users, it is only honoured when a post is created.
+	Anonymous bool
+	// Status and PublishAt are only honoured when a post is created, PublishAt is set for scheduled posts.
+	Status    string
+	PublishAt time.Time
+}
+
+const (
+	TagsStatusPending  = "pending"
+	TagsStatusComplete = "complete"
+)
+
+const (
+	PostStatusDraft     = "draft"
+	PostStatusScheduled = "scheduled"
+	PostStatusPublished = "published"
+)
+
+// generateTags returns the tags for content and their status.
+// With a queue, AI tagging is deferred and hashtags are used until the queued job completes.
+func generateTags(ctx context.Context, logger log.Logger, ai Tagger, queue TagQueue, content string) ([]string, string) {
+	if queue != nil {
+		return generateTagsFromHashtags(content), TagsStatusPending
+	}
+
+	tags, err := ai.GenerateTags(ctx, content)
+	if err != nil {
+		logger.Log("failed to generate AI tags, falling back", "error", err)
+		// Fallback to hashtag generation on error
+		tags = generateTagsFromHashtags(content)
+	}
+	return tags, TagsStatusComplete
 }
 
 // GET /feed
@@ -38,9 +119,21 @@ func GetFeed(logger log.Logger, s Service) http.HandlerFunc {
 }
 
 // POST /posts
-func CreatePost(logger log.Logger, s Service, ai *genai.Service) http.HandlerFunc {
+//
+// A publish_at in the future schedules the post rather than publishing it immediately.
+func CreatePost(logger log.Logger, s Service, ai Tagger, tagQueue TagQueue, moderator Moderator, media Media, previewer Previewer) http.HandlerFunc {
+	return createPost(logger, s, ai, tagQueue, moderator, media, previewer, false)
+}
+
+// createPost creates a post, or a draft which is scheduled if publish_at is set.
+// publish_at must be in the future, as scheduled posts are dated when they are due.
+func createPost(logger log.Logger, s Service, ai Tagger, tagQueue TagQueue, moderator Moderator, media Media, previewer Previewer, draft bool) http.HandlerFunc {
 	type request struct {
-		Bollocks string `json:"bollocks"`
+		Bollocks  string     `json:"bollocks"`
+		Anonymous bool       `json:"anonymous"`
+		PublishAt *time.Time `json:"publish_at"`
+		// Attachments are the IDs of uploads to attach.
+		Attachments []string `json:"attachments"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -50,26 +143,60 @@ func CreatePost(logger log.Logger, s Service, ai *genai.Service) http.HandlerFun
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if req.PublishAt != nil && !req.PublishAt.After(time.Now()) {
+			http.Error(w, "publish_at must be in the future", http.StatusBadRequest)
+			return
+		}
 
-		tags, err := ai.GenerateTags(r.Context(), req.Bollocks)
+		moderation, err := moderate(r.Context(), moderator, req.Bollocks)
 		if err != nil {
-			logger.Log("failed to generate AI tags, falling back", "error", err)
-			// Fallback to hashtag generation on error
-			tags = generateTagsFromHashtags(req.Bollocks)
+			logger.Log("failed to moderate post", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if moderation != nil && moderation.Decision == ModerationRejected {
+			writeRejected(w, moderation)
+			return
+		}
+
+		content := PostContent{
+			Bollocks:  req.Bollocks,
+			Anonymous: req.Anonymous,
+			Status:    PostStatusPublished,
+		}
+		switch {
+		case req.PublishAt != nil:
+			content.Status, content.PublishAt = PostStatusScheduled, *req.PublishAt
+		case draft:
+			content.Status = PostStatusDraft
+		}
+
+		content.Attachments, err = attach(r.Context(), media, req.Attachments)
+		if err != nil {
+			writeAttachError(w, logger, err)
+			return
 		}
 
-		post, err := s.CreatePost(r.Context(), req.Bollocks, tags)
+		content.Moderation = moderation
+		content.Tags, content.TagsStatus = generateTags(r.Context(), logger, ai, tagQueue, req.Bollocks)
+		content.LinkPreviews = linkPreviews(r.Context(), previewer, req.Bollocks)
+		content.Entities = extractEntities(req.Bollocks)
+
+		post, err := s.CreatePost(r.Context(), content)
 		if err != nil {
 			logger.Log("failed to create post", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		if content.TagsStatus == TagsStatusPending && !tagQueue.Enqueue(post.ID, req.Bollocks) {
+			logger.Log("tag queue full, post left pending", "post_id", post.ID)
+		}
 
+		setETag(w, post)
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Location", "/posts/"+post.ID)
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(post)
-
 	}
 }
 
@@ -89,10 +216,38 @@ func GetPosts(logger log.Logger, s Service) http.HandlerFunc {
 	}
 }
 
+// GET /posts/{postId}
+func GetPost(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID := r.PathValue("postId")
+		post, err := s.GetPost(r.Context(), postID)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to get post", "error", err, "post_id", postID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		setETag(w, post)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(post)
+	}
+}
+
 // PATCH /posts/{postId}
-func UpdatePost(logger log.Logger, s Service, ai *genai.Service) http.HandlerFunc {
+//
+// An If-Match header makes the update conditional on the post not having changed since it was read.
+// A conflict is returned if the post is written in the background while it is updated, which may be retried.
+func UpdatePost(logger log.Logger, s Service, ai Tagger, tagQueue TagQueue, moderator Moderator, media Media, previewer Previewer) http.HandlerFunc {
 	type request struct {
 		Bollocks string `json:"bollocks"`
+		// Attachments are the IDs of uploads to attach, replacing the current attachments unless omitted.
+		Attachments []string `json:"attachments"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -104,20 +259,50 @@ func UpdatePost(logger log.Logger, s Service, ai *genai.Service) http.HandlerFun
 		}
 
 		postID := r.PathValue("postId")
-		tags, err := ai.GenerateTags(r.Context(), req.Bollocks)
+		version, ok := parseIfMatch(r.Header.Get("If-Match"))
+		if !ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		moderation, err := moderate(r.Context(), moderator, req.Bollocks)
+		if err != nil {
+			logger.Log("failed to moderate post", "error", err, "post_id", postID)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if moderation != nil && moderation.Decision == ModerationRejected {
+			writeRejected(w, moderation)
+			return
+		}
+
+		attachments, err := attach(r.Context(), media, req.Attachments)
 		if err != nil {
-			logger.Log("failed to generate AI tags, falling back", "error", err)
-			// Fallback to hashtag generation on error
-			tags = generateTagsFromHashtags(req.Bollocks)
+			writeAttachError(w, logger, err)
+			return
 		}
 
-		post, err := s.UpdatePost(r.Context(), postID, req.Bollocks, tags)
+		tags, tagsStatus := generateTags(r.Context(), logger, ai, tagQueue, req.Bollocks)
+
+		post, err := s.UpdatePost(r.Context(), postID, version, PostContent{
+			Bollocks:     req.Bollocks,
+			Tags:         tags,
+			TagsStatus:   tagsStatus,
+			Moderation:   moderation,
+			Attachments:  attachments,
+			LinkPreviews: linkPreviews(r.Context(), previewer, req.Bollocks),
+			Entities:     extractEntities(req.Bollocks),
+		})
 		if err != nil {
 			switch {
 			case status.Code(err) == codes.PermissionDenied:
 				w.WriteHeader(http.StatusForbidden)
 			case status.Code(err) == codes.NotFound:
 				w.WriteHeader(http.StatusNotFound)
+			case status.Code(err) == codes.FailedPrecondition:
+				w.WriteHeader(http.StatusPreconditionFailed)
+			case status.Code(err) == codes.Aborted:
+				w.WriteHeader(http.StatusConflict)
 			default:
 				logger.Log("failed to update bollocks", "error", err, "post_id", postID)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -125,10 +310,14 @@ func UpdatePost(logger log.Logger, s Service, ai *genai.Service) http.HandlerFun
 			return
 		}
 
+		if tagsStatus == TagsStatusPending && !tagQueue.Enqueue(post.ID, req.Bollocks) {
+			logger.Log("tag queue full, post left pending", "post_id", post.ID)
+		}
+
+		setETag(w, post)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(post)
-
 	}
 }
 
@@ -154,27 +343,53 @@ func DeletePost(logger log.Logger, s Service) http.HandlerFunc {
 	}
 }
 
-// POST /posts/{postId}/likes
-func LikePost(logger log.Logger, s Service) http.HandlerFunc {
+// POST /posts/{postId}/restore
+func RestorePost(logger log.Logger, s Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		postID := r.PathValue("postId")
-		post, err := s.ToggleLike(r.Context(), postID)
+		post, err := s.RestorePost(r.Context(), postID)
 		if err != nil {
 			switch {
 			case status.Code(err) == codes.PermissionDenied:
 				w.WriteHeader(http.StatusForbidden)
 			case status.Code(err) == codes.NotFound:
 				w.WriteHeader(http.StatusNotFound)
+			case status.Code(err) == codes.FailedPrecondition:
+				w.WriteHeader(http.StatusConflict)
 			default:
-				logger.Log("failed to toggle like", "error", err, "post_id", postID)
+				logger.Log("failed to restore post", "error", err, "post_id", postID)
 				w.WriteHeader(http.StatusInternalServerError)
 			}
 			return
 		}
 
+		setETag(w, post)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(post)
+	}
+}
 
+func setETag(w http.ResponseWriter, post *Post) {
+	if post.Version != "" {
+		w.Header().Set("ETag", `"`+post.Version+`"`)
+	}
+}
+
+// parseIfMatch returns the post version required by an If-Match header, empty if any version matches.
+// Weak tags never match as the comparison must be strong, and lists of tags are not supported.
+func parseIfMatch(header string) (string, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return "", true
+	}
+	version, ok := strings.CutPrefix(header, `"`)
+	if !ok {
+		return "", false
+	}
+	version, ok = strings.CutSuffix(version, `"`)
+	if !ok || version == "" || strings.ContainsAny(version, `",`) {
+		return "", false
 	}
+	return version, true
 }
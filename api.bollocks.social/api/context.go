@@ -1,10 +1,16 @@
 package api
 
-import "context"
+import (
+	"context"
+	"slices"
+)
 
 type contextKey int
 
-var userIdKey contextKey
+const (
+	userIdKey contextKey = iota
+	rolesKey
+)
 
 func ContextWithUserId(ctx context.Context, userId string) context.Context {
 	return context.WithValue(ctx, userIdKey, userId)
@@ -14,3 +20,16 @@ func ContextGetUserId(ctx context.Context) (string, bool) {
 	v, ok := ctx.Value(userIdKey).(string)
 	return v, ok
 }
+
+func ContextWithRoles(ctx context.Context, roles []string) context.Context {
+	return context.WithValue(ctx, rolesKey, roles)
+}
+
+func ContextGetRoles(ctx context.Context) []string {
+	v, _ := ctx.Value(rolesKey).([]string)
+	return v
+}
+
+func ContextHasRole(ctx context.Context, role string) bool {
+	return slices.Contains(ContextGetRoles(ctx), role)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/handlers"
+)
+
+// CORSConfig configures the cross-origin resource sharing middleware.
+type CORSConfig struct {
+	// AllowedOrigins may contain exact origins ("https://bollocks.social"),
+	// wildcard subdomain patterns ("https://*.preview.bollocks.social") or "*".
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+}
+
+func CORS(cfg CORSConfig) func(next http.Handler) http.Handler {
+	opts := []handlers.CORSOption{
+		handlers.AllowedOrigins(cfg.AllowedOrigins),
+		handlers.AllowedOriginValidator(originValidator(cfg.AllowedOrigins)),
+		handlers.AllowedMethods(cfg.AllowedMethods),
+		handlers.AllowedHeaders(cfg.AllowedHeaders),
+		handlers.ExposedHeaders(cfg.ExposedHeaders),
+	}
+	if cfg.AllowCredentials {
+		opts = append(opts, handlers.AllowCredentials())
+	}
+	if cfg.MaxAge > 0 {
+		opts = append(opts, handlers.MaxAge(cfg.MaxAge))
+	}
+	return handlers.CORS(opts...)
+}
+
+// originValidator matches an Origin header against exact origins and wildcard subdomain patterns.
+// A wildcard only matches one or more subdomain labels, never the bare domain itself.
+func originValidator(allowed []string) handlers.OriginValidator {
+	return func(origin string) bool {
+		for _, pattern := range allowed {
+			if pattern == "*" || strings.EqualFold(pattern, origin) {
+				return true
+			}
+			scheme, host, ok := strings.Cut(pattern, "://*.")
+			if !ok {
+				continue
+			}
+			prefix := strings.ToLower(scheme + "://")
+			o := strings.ToLower(origin)
+			if !strings.HasPrefix(o, prefix) {
+				continue
+			}
+			sub, ok := strings.CutSuffix(strings.TrimPrefix(o, prefix), "."+strings.ToLower(host))
+			if ok && sub != "" && !strings.ContainsAny(sub, "/:@") {
+				return true
+			}
+		}
+		return false
+	}
+}
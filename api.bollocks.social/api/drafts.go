@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GET /drafts
+func ListDrafts(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		posts, err := s.ListDrafts(r.Context())
+		if err != nil {
+			logger.Log("failed to list drafts", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(posts)
+	}
+}
+
+// POST /drafts
+//
+// Drafts are moderated and tagged like posts but only published by PublishPost,
+// or by the scheduler once publish_at has passed if it is set.
+func CreateDraft(logger log.Logger, s Service, ai Tagger, tagQueue TagQueue, moderator Moderator, media Media, previewer Previewer) http.HandlerFunc {
+	return createPost(logger, s, ai, tagQueue, moderator, media, previewer, true)
+}
+
+// POST /drafts/{postId}/publish
+func PublishPost(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID := r.PathValue("postId")
+		post, err := s.PublishPost(r.Context(), postID)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.PermissionDenied:
+				w.WriteHeader(http.StatusForbidden)
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			case status.Code(err) == codes.FailedPrecondition:
+				w.WriteHeader(http.StatusConflict)
+			default:
+				logger.Log("failed to publish post", "error", err, "post_id", postID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		setETag(w, post)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(post)
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LikesPage is a page of the users who like a post.
+type LikesPage struct {
+	Likers     []Author `json:"likers"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+const (
+	defaultLikesPageSize = 50
+	maxLikesPageSize     = 100
+)
+
+// POST /posts/{postId}/likes
+//
+// Deprecated: a retried request un-likes the post, use PUT or DELETE /posts/{postId}/likes/me.
+func ToggleLike(logger log.Logger, s Service) http.HandlerFunc {
+	return likeHandler(logger, "failed to toggle like", s.ToggleLike)
+}
+
+// PUT /posts/{postId}/likes/me
+func LikePost(logger log.Logger, s Service) http.HandlerFunc {
+	return likeHandler(logger, "failed to like post", s.LikePost)
+}
+
+// DELETE /posts/{postId}/likes/me
+func UnlikePost(logger log.Logger, s Service) http.HandlerFunc {
+	return likeHandler(logger, "failed to unlike post", s.UnlikePost)
+}
+
+func likeHandler(logger log.Logger, msg string, fn func(ctx context.Context, postID string) (*Post, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID := r.PathValue("postId")
+		post, err := fn(r.Context(), postID)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.PermissionDenied:
+				w.WriteHeader(http.StatusForbidden)
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log(msg, "error", err, "post_id", postID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(post)
+	}
+}
+
+// GET /posts/{postId}/likes
+func ListLikes(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultLikesPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxLikesPageSize)
+		}
+
+		postID := r.PathValue("postId")
+		page, err := s.ListLikes(r.Context(), postID, r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.InvalidArgument:
+				w.WriteHeader(http.StatusBadRequest)
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to list likes", "error", err, "post_id", postID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(page)
+	}
+}
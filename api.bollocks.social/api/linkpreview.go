@@ -0,0 +1,26 @@
+package api
+
+import "context"
+
+// LinkPreview is a summary of a page linked from a post.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// Previewer unfurls the URLs in the content of a post. It is best effort, leaving out
+// URLs that cannot be previewed rather than failing the post.
+type Previewer interface {
+	Previews(ctx context.Context, content string) []LinkPreview
+}
+
+// linkPreviews returns previews of the URLs in content, or nil if link previews are disabled.
+func linkPreviews(ctx context.Context, p Previewer, content string) []LinkPreview {
+	if p == nil {
+		return nil
+	}
+	return p.Previews(ctx, content)
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Attachment is an uploaded file attached to a post.
+type Attachment struct {
+	ID          string `json:"id"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// Width and Height are in pixels, zero for files that are not images.
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	URL    string `json:"url"`
+	// ThumbnailURL is empty if no thumbnail could be generated.
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// UploadTarget tells the client where to upload a file before attaching it to a post by ID.
+type UploadTarget struct {
+	ID      string            `json:"id"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// ExpiresAt is when the URL stops accepting the upload.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Media stores files uploaded by users for attachment to posts.
+type Media interface {
+	// CreateUpload validates the declared file and returns where to upload it.
+	CreateUpload(ctx context.Context, contentType string, size int64) (*UploadTarget, error)
+	// Upload stores a file for upload targets served by the API rather than the blob store.
+	// It fails with NotFound if the caller created no such upload, and FailedPrecondition once it has expired or been attached.
+	Upload(ctx context.Context, uploadID, contentType string, r io.Reader) error
+	// Attach validates an uploaded file and prepares it, generating its thumbnail, to be attached to a post.
+	Attach(ctx context.Context, uploadID string) (*Attachment, error)
+}
+
+// maxAttachments is the number of files that may be attached to a post.
+const maxAttachments = 4
+
+// attach returns the attachments for uploaded files, or nil if uploadIDs is nil.
+// It fails with InvalidArgument if attachments are unsupported, too many, or any upload is invalid.
+func attach(ctx context.Context, m Media, uploadIDs []string) ([]Attachment, error) {
+	if uploadIDs == nil {
+		return nil, nil
+	}
+	if len(uploadIDs) > 0 && m == nil {
+		return nil, status.Error(codes.InvalidArgument, "attachments are not supported")
+	}
+	if len(uploadIDs) > maxAttachments {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d attachments are allowed", maxAttachments)
+	}
+
+	attachments := make([]Attachment, 0, len(uploadIDs))
+	for _, id := range uploadIDs {
+		a, err := m.Attach(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, *a)
+	}
+	return attachments, nil
+}
+
+// writeAttachError writes the response for a failure to attach uploads to a post.
+func writeAttachError(w http.ResponseWriter, logger log.Logger, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound:
+		http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+	case codes.FailedPrecondition:
+		http.Error(w, status.Convert(err).Message(), http.StatusConflict)
+	default:
+		logger.Log("failed to attach uploads", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// POST /uploads
+func CreateUpload(logger log.Logger, m Media) http.HandlerFunc {
+	type request struct {
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		target, err := m.CreateUpload(r.Context(), req.ContentType, req.Size)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.InvalidArgument:
+				http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+			default:
+				logger.Log("failed to create upload", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(target)
+	}
+}
+
+// PUT /uploads/{uploadId}
+func PutUpload(logger log.Logger, m Media) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		uploadID := r.PathValue("uploadId")
+		err := m.Upload(r.Context(), uploadID, r.Header.Get("Content-Type"), r.Body)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.InvalidArgument:
+				http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+			case status.Code(err) == codes.NotFound:
+				http.Error(w, status.Convert(err).Message(), http.StatusNotFound)
+			case status.Code(err) == codes.FailedPrecondition:
+				http.Error(w, status.Convert(err).Message(), http.StatusConflict)
+			case status.Code(err) == codes.ResourceExhausted:
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			default:
+				logger.Log("failed to store upload", "error", err, "upload_id", uploadID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	ModerationApproved    = "approved"
+	ModerationQuarantined = "quarantined"
+	ModerationRejected    = "rejected"
+	// ModerationUnchecked is recorded when classification failed and the post was published regardless.
+	ModerationUnchecked = "unchecked"
+	// ModerationHidden is reported for posts hidden after being reported by users.
+	ModerationHidden = "hidden"
+)
+
+// Moderation is the verdict reached when a post was moderated.
+type Moderation struct {
+	Decision string `json:"decision"`
+	// Reason is the category that led to the post being quarantined or rejected.
+	Reason    string             `json:"reason,omitempty"`
+	Scores    map[string]float64 `json:"scores,omitempty"`
+	CheckedAt time.Time          `json:"checked_at"`
+}
+
+// Moderator classifies content before it is published.
+type Moderator interface {
+	Moderate(ctx context.Context, content string) (*Moderation, error)
+}
+
+// moderate returns the moderation verdict for content, or nil if moderation is disabled.
+func moderate(ctx context.Context, m Moderator, content string) (*Moderation, error) {
+	if m == nil {
+		return nil, nil
+	}
+	return m.Moderate(ctx, content)
+}
+
+// writeRejected responds with the reason content was rejected by moderation.
+func writeRejected(w http.ResponseWriter, m *Moderation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":  "content rejected by moderation",
+		"reason": m.Reason,
+	})
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	NotificationLike    = "like"
+	NotificationMention = "mention"
+)
+
+// Notification tells a user that others acted on one of their posts. Actions of the same type
+// on the same post are aggregated, e.g. "5 people liked your post".
+type Notification struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	PostID string `json:"post_id"`
+	// Actors are the most recent users to act, empty for mentions by anonymous posts.
+	// ActorCount is the total number of users who acted.
+	Actors     []Author  `json:"actors"`
+	ActorCount int       `json:"actor_count"`
+	Read       bool      `json:"read"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// NotificationsPage is a page of a user's notifications.
+type NotificationsPage struct {
+	Notifications []Notification `json:"notifications"`
+	// UnreadCount is the number of all the user's unread notifications, not only those on the page.
+	UnreadCount int    `json:"unread_count"`
+	NextCursor  string `json:"next_cursor,omitempty"`
+}
+
+const (
+	defaultNotificationsPageSize = 20
+	maxNotificationsPageSize     = 100
+)
+
+// GET /notifications
+func ListNotifications(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultNotificationsPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxNotificationsPageSize)
+		}
+
+		page, err := s.ListNotifications(r.Context(), r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.InvalidArgument:
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				logger.Log("failed to list notifications", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// POST /notifications/{notificationId}/read
+func MarkNotificationRead(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		notificationID := r.PathValue("notificationId")
+		if err := s.MarkNotificationRead(r.Context(), notificationID); err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to mark notification read", "error", err, "notification_id", notificationID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// POST /notifications/read
+func MarkAllNotificationsRead(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.MarkAllNotificationsRead(r.Context()); err != nil {
+			logger.Log("failed to mark notifications read", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
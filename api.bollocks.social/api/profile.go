@@ -3,16 +3,32 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"regexp"
 	"slices"
 	"strings"
 
 	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Profile struct {
-	Interests []string `json:"interests"`
+	Interests   []string `json:"interests"`
+	Handle      string   `json:"handle,omitempty"`
+	DisplayName string   `json:"display_name,omitempty"`
+	AvatarURL   string   `json:"avatar_url,omitempty"`
 }
 
+// ProfileUpdate holds the profile fields to change, nil fields are left as they are.
+type ProfileUpdate struct {
+	Interests   []string
+	Handle      *string
+	DisplayName *string
+	AvatarURL   *string
+}
+
+var handleRe = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+
 func GetMyProfile(logger log.Logger, s Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		profile, err := s.GetMyProfile(r.Context())
@@ -30,7 +46,10 @@ func GetMyProfile(logger log.Logger, s Service) http.HandlerFunc {
 
 func UpdateMyProfile(logger log.Logger, s Service) http.HandlerFunc {
 	type request struct {
-		Interests []string `json:"interests"`
+		Interests   []string `json:"interests"`
+		Handle      *string  `json:"handle"`
+		DisplayName *string  `json:"display_name"`
+		AvatarURL   *string  `json:"avatar_url"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req request
@@ -40,17 +59,44 @@ func UpdateMyProfile(logger log.Logger, s Service) http.HandlerFunc {
 			return
 		}
 
+		update := ProfileUpdate{
+			DisplayName: req.DisplayName,
+			AvatarURL:   req.AvatarURL,
+		}
+
 		// Basic sanitization
-		var interests []string
-		for _, interest := range req.Interests {
-			cleanInterest := strings.ToLower(strings.TrimSpace(interest))
-			if cleanInterest != "" {
-				interests = append(interests, cleanInterest)
+		if req.Interests != nil {
+			update.Interests = []string{}
+			for _, interest := range req.Interests {
+				cleanInterest := strings.ToLower(strings.TrimSpace(interest))
+				if cleanInterest != "" {
+					update.Interests = append(update.Interests, cleanInterest)
+				}
+			}
+			update.Interests = slices.Compact(update.Interests)
+		}
+		if req.Handle != nil {
+			handle := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(*req.Handle), "@"))
+			if !handleRe.MatchString(handle) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode("handle must be 3 to 30 letters, digits or underscores")
+				return
 			}
+			update.Handle = &handle
+		}
+		if req.AvatarURL != nil && *req.AvatarURL != "" && !strings.HasPrefix(*req.AvatarURL, "https://") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode("avatar_url must be an https URL")
+			return
 		}
-		interests = slices.Compact(interests)
-		profile, err := s.UpdateMyProfile(r.Context(), interests)
+
+		profile, err := s.UpdateMyProfile(r.Context(), update)
 		if err != nil {
+			if status.Code(err) == codes.AlreadyExists {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode("handle is taken")
+				return
+			}
 			logger.Log("failed to update user profile", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
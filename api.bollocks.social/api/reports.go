@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ReportStatusOpen     = "open"
+	ReportStatusResolved = "resolved"
+
+	// ReportActionDismiss resolves a report leaving the post as it is.
+	ReportActionDismiss = "dismiss"
+	// ReportActionRemove resolves a report hiding the post from the feed.
+	ReportActionRemove = "remove"
+)
+
+// ReportReasons are the reasons a post may be reported for.
+var ReportReasons = []string{"spam", "harassment", "hate", "sexual", "other"}
+
+// Report is a user's report of an abusive post.
+type Report struct {
+	ID         string     `json:"id"`
+	PostID     string     `json:"post_id"`
+	Reporter   string     `json:"reporter"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details,omitempty"`
+	Status     string     `json:"status"`
+	Action     string     `json:"action,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// POST /posts/{postId}/reports
+func ReportPost(logger log.Logger, s Service) http.HandlerFunc {
+	type request struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !slices.Contains(ReportReasons, req.Reason) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		postID := r.PathValue("postId")
+		report, err := s.ReportPost(r.Context(), postID, req.Reason, req.Details)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			case status.Code(err) == codes.AlreadyExists:
+				w.WriteHeader(http.StatusConflict)
+			case status.Code(err) == codes.InvalidArgument:
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				logger.Log("failed to report post", "error", err, "post_id", postID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// GET /admin/reports
+func ListReports(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reportStatus := r.URL.Query().Get("status")
+		if reportStatus == "" {
+			reportStatus = ReportStatusOpen
+		}
+
+		reports, err := s.ListReports(r.Context(), reportStatus)
+		if err != nil {
+			logger.Log("failed to list reports", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(reports)
+	}
+}
+
+// POST /admin/reports/{reportId}/resolve
+func ResolveReport(logger log.Logger, s Service) http.HandlerFunc {
+	type request struct {
+		Action string `json:"action"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Action != ReportActionDismiss && req.Action != ReportActionRemove) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		reportID := r.PathValue("reportId")
+		report, err := s.ResolveReport(r.Context(), reportID, req.Action)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to resolve report", "error", err, "report_id", reportID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// POST /admin/posts/{postId}/restore
+func RestoreReportedPost(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postID := r.PathValue("postId")
+		if err := s.RestoreReportedPost(r.Context(), postID); err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to restore post", "error", err, "post_id", postID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mchipperfield/gocore/log"
+)
+
+const (
+	FeedEventPost  = "post"
+	FeedEventLikes = "likes"
+)
+
+// FeedEvent is a change to the caller's feed. Post is set for new posts and Likes for changes to a post's like count.
+type FeedEvent struct {
+	Type  string
+	Post  *Post
+	Likes *LikeCount
+}
+
+// LikeCount is the number of likes of a post.
+type LikeCount struct {
+	PostID string `json:"post_id"`
+	Likes  int    `json:"likes"`
+}
+
+// StreamConfig configures long-lived streaming responses.
+type StreamConfig struct {
+	// Heartbeat is how often a comment is written to an idle stream so neither the server
+	// nor proxies between it and the client close the connection.
+	Heartbeat time.Duration
+	// WriteTimeout is the deadline for each write to a stream, in place of the server's
+	// WriteTimeout which would otherwise end the stream.
+	WriteTimeout time.Duration
+	// Done is closed when the server shuts down, ending open streams so they do not hold up shutdown.
+	Done <-chan struct{}
+}
+
+// GET /feed/stream
+func StreamFeed(logger log.Logger, s Service, hub Hub, cfg StreamConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		rc := http.NewResponseController(w)
+		write := func(format string, args ...any) error {
+			if err := rc.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, format, args...); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if err := write(": connected\n\n"); err != nil {
+			logger.Log("failed to start feed stream", "error", err)
+			return
+		}
+
+		userID, _ := ContextGetUserId(ctx)
+		sub := hub.Subscribe(userID)
+		defer sub.Close()
+		events := make(chan FeedEvent)
+		watchErr := make(chan error, 1)
+		go func() {
+			watchErr <- s.WatchFeed(ctx, sub, events)
+		}()
+
+		heartbeat := time.NewTicker(cfg.Heartbeat)
+		defer heartbeat.Stop()
+		for {
+			var err error
+			select {
+			case event := <-events:
+				var data any = event.Post
+				if event.Type == FeedEventLikes {
+					data = event.Likes
+				}
+				b, _ := json.Marshal(data)
+				err = write("event: %s\ndata: %s\n\n", event.Type, b)
+			case <-heartbeat.C:
+				err = write(": heartbeat\n\n")
+			case err := <-watchErr:
+				if ctx.Err() == nil {
+					logger.Log("failed to watch feed", "error", err)
+				}
+				return
+			case <-cfg.Done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				// The client has gone away.
+				return
+			}
+		}
+	}
+}
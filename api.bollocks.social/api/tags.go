@@ -1,22 +1,41 @@
 package api
 
-import (
-	"regexp"
-	"slices"
-	"strings"
-)
+import "github.com/mchipperfield/bollocks/api.bollocks.social/entities"
+
+// Entity is a hashtag, @mention or URL in the content of a post, so clients can render it as a link.
+type Entity struct {
+	// Type is hashtag, mention or url.
+	Type string `json:"type"`
+	// Start and End are offsets in Unicode code points into the content, End is exclusive.
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// StartUTF16 and EndUTF16 are the same offsets in UTF-16 code units, as JavaScript strings are indexed.
+	StartUTF16 int `json:"start_utf16"`
+	EndUTF16   int `json:"end_utf16"`
+	// Value is the lowercased tag without its #, the lowercased handle without its @, or the URL.
+	Value string `json:"value"`
+}
 
 // generateTagsFromHashtags is a fallback to extract hashtags from content.
 func generateTagsFromHashtags(content string) []string {
-	re := regexp.MustCompile(`#(\w+)`)
-	matches := re.FindAllStringSubmatch(content, -1)
-	tags := make([]string, 0, len(matches))
-	for _, match := range matches {
-		if len(match) > 1 {
-			tags = append(tags, strings.ToLower(match[1]))
-		}
-	}
-	slices.Sort(tags)
-	return slices.Compact(tags)
+	return entities.Hashtags(content)
+}
 
+// extractEntities returns the entities in content. Mentions are only kept by the service
+// if they resolve to a user.
+func extractEntities(content string) []Entity {
+	extracted := entities.Extract(content)
+	offsets := entities.UTF16Offsets(content)
+	ents := make([]Entity, 0, len(extracted))
+	for _, e := range extracted {
+		ents = append(ents, Entity{
+			Type:       e.Type,
+			Start:      e.Start,
+			End:        e.End,
+			StartUTF16: offsets[e.Start],
+			EndUTF16:   offsets[e.End],
+			Value:      e.Value,
+		})
+	}
+	return ents
 }
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// POST /users/{userId}/block
+func BlockUser(logger log.Logger, s Service) http.HandlerFunc {
+	return relationshipHandler(logger, "failed to block user", s.BlockUser)
+}
+
+// DELETE /users/{userId}/block
+func UnblockUser(logger log.Logger, s Service) http.HandlerFunc {
+	return relationshipHandler(logger, "failed to unblock user", s.UnblockUser)
+}
+
+// POST /users/{userId}/mute
+func MuteUser(logger log.Logger, s Service) http.HandlerFunc {
+	return relationshipHandler(logger, "failed to mute user", s.MuteUser)
+}
+
+// DELETE /users/{userId}/mute
+func UnmuteUser(logger log.Logger, s Service) http.HandlerFunc {
+	return relationshipHandler(logger, "failed to unmute user", s.UnmuteUser)
+}
+
+// relationshipHandler applies fn to the user in the path on behalf of the caller.
+func relationshipHandler(logger log.Logger, msg string, fn func(ctx context.Context, userID string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("userId")
+		if err := fn(r.Context(), userID); err != nil {
+			switch {
+			case status.Code(err) == codes.InvalidArgument:
+				w.WriteHeader(http.StatusBadRequest)
+			default:
+				logger.Log(msg, "error", err, "user_id", userID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
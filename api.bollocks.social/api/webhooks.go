@@ -0,0 +1,224 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Webhooks only see posts while they are visible to other users, so a post that is hidden, quarantined
+// or unpublished is sent as deleted, and one that becomes visible again as created.
+const (
+	WebhookEventPostCreated = "post.created"
+	WebhookEventPostUpdated = "post.updated"
+	WebhookEventPostDeleted = "post.deleted"
+	WebhookEventPostLiked   = "post.liked"
+
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusSucceeded = "succeeded"
+	DeliveryStatusFailed    = "failed"
+)
+
+// WebhookEvents are the events a webhook may subscribe to.
+var WebhookEvents = []string{WebhookEventPostCreated, WebhookEventPostUpdated, WebhookEventPostDeleted, WebhookEventPostLiked}
+
+// Webhook is an endpoint that events are delivered to. A user's webhooks receive events about
+// their own posts, global webhooks registered by admins receive events about every post.
+type Webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Global bool     `json:"global"`
+	// Secret signs each delivery, it is only returned when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookInput is what is written to a webhook when it is registered.
+type WebhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// WebhookPayload is the body of a delivery. ID identifies the event, so receivers can
+// ignore events delivered to them more than once.
+type WebhookPayload struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"created_at"`
+	Post      *WebhookPost `json:"post"`
+}
+
+// WebhookPost is the post an event is about. Only its ID is set for deleted posts.
+type WebhookPost struct {
+	ID        string     `json:"id"`
+	Bollocks  string     `json:"bollocks,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Anonymous bool       `json:"anonymous,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// WebhookDelivery is an event queued for delivery to a webhook, Log holds each attempt to deliver it.
+type WebhookDelivery struct {
+	ID            string           `json:"id"`
+	WebhookID     string           `json:"webhook_id"`
+	Event         string           `json:"event"`
+	Payload       json.RawMessage  `json:"payload"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	Log           []WebhookAttempt `json:"log,omitempty"`
+	// URL and Secret are those of the webhook, used to make the delivery and not returned by the API.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookAttempt is the outcome of an attempt to deliver an event. StatusCode is zero if no response was received.
+type WebhookAttempt struct {
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// validWebhook reports whether a webhook may be registered. Deliveries are only made over HTTPS
+// to the standard port, so signed payloads cannot be read in transit.
+func validWebhook(in WebhookInput) bool {
+	u, err := url.Parse(in.URL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil || (u.Port() != "" && u.Port() != "443") {
+		return false
+	}
+	if len(in.Events) == 0 {
+		return false
+	}
+	for _, event := range in.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			return false
+		}
+	}
+	return true
+}
+
+// POST /webhooks and POST /admin/webhooks, where global webhooks are registered.
+func CreateWebhook(logger log.Logger, s Service, global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var in WebhookInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || !validWebhook(in) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		webhook, err := s.CreateWebhook(r.Context(), in, global)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.ResourceExhausted:
+				w.WriteHeader(http.StatusConflict)
+			default:
+				logger.Log("failed to create webhook", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Location", "/webhooks/"+webhook.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(webhook)
+	}
+}
+
+// GET /webhooks and GET /admin/webhooks, where global webhooks are listed.
+func ListWebhooks(logger log.Logger, s Service, global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhooks, err := s.ListWebhooks(r.Context(), global)
+		if err != nil {
+			logger.Log("failed to list webhooks", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(webhooks)
+	}
+}
+
+// DELETE /webhooks/{webhookId}
+func DeleteWebhook(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookID := r.PathValue("webhookId")
+		if err := s.DeleteWebhook(r.Context(), webhookID); err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to delete webhook", "error", err, "webhook_id", webhookID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GET /webhooks/{webhookId}/deliveries
+func ListWebhookDeliveries(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookID := r.PathValue("webhookId")
+		deliveryStatus := r.URL.Query().Get("status")
+		if deliveryStatus != "" && !slices.Contains([]string{DeliveryStatusPending, DeliveryStatusSucceeded, DeliveryStatusFailed}, deliveryStatus) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		deliveries, err := s.ListWebhookDeliveries(r.Context(), webhookID, deliveryStatus)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to list webhook deliveries", "error", err, "webhook_id", webhookID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(deliveries)
+	}
+}
+
+// GET /webhooks/{webhookId}/deliveries/{deliveryId}
+func GetWebhookDelivery(logger log.Logger, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhookID, deliveryID := r.PathValue("webhookId"), r.PathValue("deliveryId")
+		delivery, err := s.GetWebhookDelivery(r.Context(), webhookID, deliveryID)
+		if err != nil {
+			switch {
+			case status.Code(err) == codes.NotFound:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				logger.Log("failed to get webhook delivery", "error", err, "webhook_id", webhookID, "delivery_id", deliveryID)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(delivery)
+	}
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mchipperfield/gocore/log"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	EventLikes        = "likes"
+	EventNotification = "notification"
+	EventPost         = "post"
+)
+
+// Event is a change made by the service, published to live subscribers.
+// Likes is set for changes to a post's like count, Notification for new or updated notifications
+// and Post for posts published to the feed, which are only published to feed streams.
+type Event struct {
+	Type         string        `json:"type"`
+	Likes        *LikeCount    `json:"likes,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+	Post         *FeedPost     `json:"-"`
+}
+
+// FeedPost is a newly published post as users other than its author see it, along with its author
+// so each subscriber can filter it by their blocks and mutes. Removed is set, with only Post.ID,
+// once a published post is deleted or withheld.
+type FeedPost struct {
+	Post    Post
+	Author  string
+	Removed bool
+}
+
+// Hub fans out changes to live subscriptions.
+type Hub interface {
+	Subscribe(userID string) Subscription
+}
+
+// Subscription receives the events a live connection is subscribed to.
+// Events is closed once the subscription is closed, including when it falls too far behind.
+type Subscription interface {
+	Events() <-chan Event
+	SubscribePost(postID string)
+	UnsubscribePost(postID string)
+	SetNotifications(on bool)
+	// SetFeed sets whether posts published to the feed are received.
+	SetFeed(on bool)
+	Close()
+}
+
+// WebSocketProtocol is the subprotocol the server selects. Browsers cannot set headers on WebSockets,
+// so they may offer the caller's bearer token as a second subprotocol of the form "bearer.<token>".
+const WebSocketProtocol = "bollocks.v1"
+
+const (
+	// maxSubscribedPosts is the number of posts a connection may be subscribed to.
+	maxSubscribedPosts = 100
+	// maxWebSocketMessage is the size in bytes of the largest message accepted from clients.
+	maxWebSocketMessage = 16 << 10
+)
+
+// wsRequest is a message from a client, e.g. {"type":"subscribe","posts":["abc"],"notifications":true}.
+type wsRequest struct {
+	Type          string   `json:"type"`
+	Posts         []string `json:"posts"`
+	Notifications bool     `json:"notifications"`
+}
+
+// wsReply is a message to a client other than an event. Subscriptions acknowledge each request
+// with the connection's subscriptions, errors report a request or post that could not be subscribed to.
+type wsReply struct {
+	Type          string   `json:"type"`
+	Posts         []string `json:"posts,omitempty"`
+	Notifications bool     `json:"notifications,omitempty"`
+	PostID        string   `json:"post_id,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// GET /ws
+func WebSocket(logger log.Logger, s Service, hub Hub, cfg StreamConfig) http.HandlerFunc {
+	srv := websocket.Server{
+		// Clients authenticate with a bearer token rather than cookies, so connections
+		// cannot be made on their behalf by other origins and the origin is not checked.
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if len(config.Protocol) == 0 {
+				return nil
+			}
+			if !slices.Contains(config.Protocol, WebSocketProtocol) {
+				return errors.New("unsupported subprotocol")
+			}
+			config.Protocol = []string{WebSocketProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			serveWebSocket(logger, s, hub, cfg, ws)
+		},
+	}
+	return srv.ServeHTTP
+}
+
+func serveWebSocket(logger log.Logger, s Service, hub Hub, cfg StreamConfig, ws *websocket.Conn) {
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	userID, _ := ContextGetUserId(ctx)
+	sub := hub.Subscribe(userID)
+	defer sub.Close()
+
+	// The server's read deadline for the upgrade request still applies to the hijacked connection.
+	ws.SetReadDeadline(time.Time{})
+	ws.MaxPayloadBytes = maxWebSocketMessage
+	send := func(v any) error {
+		if err := ws.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+			return err
+		}
+		return websocket.JSON.Send(ws, v)
+	}
+	ping := func() error {
+		if err := ws.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+			return err
+		}
+		ws.PayloadType = websocket.PingFrame
+		defer func() { ws.PayloadType = websocket.TextFrame }()
+		_, err := ws.Write(nil)
+		return err
+	}
+
+	requests := make(chan wsRequest)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				readErr <- err
+				return
+			}
+			// Malformed messages are answered as unknown requests.
+			var req wsRequest
+			json.Unmarshal(msg, &req)
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var posts []string
+	notifications := false
+	subscribe := func(postID string) error {
+		if slices.Contains(posts, postID) {
+			return nil
+		}
+		if len(posts) >= maxSubscribedPosts {
+			return send(wsReply{Type: "error", PostID: postID, Error: "too many subscriptions"})
+		}
+		post, err := s.GetPost(ctx, postID)
+		if err != nil {
+			if status.Code(err) != codes.NotFound {
+				logger.Log("failed to get post", "error", err, "post_id", postID)
+				return send(wsReply{Type: "error", PostID: postID, Error: "internal error"})
+			}
+			return send(wsReply{Type: "error", PostID: postID, Error: "post not found"})
+		}
+		posts = append(posts, postID)
+		sub.SubscribePost(postID)
+		// The current count is sent so clients need not fetch it separately.
+		return send(Event{Type: EventLikes, Likes: &LikeCount{PostID: postID, Likes: post.Likes}})
+	}
+	handle := func(req wsRequest) error {
+		switch req.Type {
+		case "subscribe":
+			for _, postID := range req.Posts {
+				if err := subscribe(postID); err != nil {
+					return err
+				}
+			}
+			if req.Notifications {
+				notifications = true
+				sub.SetNotifications(true)
+			}
+		case "unsubscribe":
+			for _, postID := range req.Posts {
+				posts = slices.DeleteFunc(posts, func(id string) bool { return id == postID })
+				sub.UnsubscribePost(postID)
+			}
+			if req.Notifications {
+				notifications = false
+				sub.SetNotifications(false)
+			}
+		default:
+			return send(wsReply{Type: "error", Error: "unknown message type"})
+		}
+		return send(wsReply{Type: "subscriptions", Posts: posts, Notifications: notifications})
+	}
+
+	heartbeat := time.NewTicker(cfg.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case req := <-requests:
+			err = handle(req)
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Dropped by the hub for falling behind, the client should reconnect.
+				return
+			}
+			err = send(event)
+		case <-heartbeat.C:
+			err = ping()
+		case <-readErr:
+			// The client closed the connection or sent a frame that could not be read.
+			return
+		case <-cfg.Done:
+			return
+		}
+		if err != nil {
+			// The client has gone away.
+			return
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Package batching runs background work periodically, in batches repeated until none remain.
+package batching
+
+import (
+	"context"
+	"time"
+)
+
+// Every calls run now and then every interval until ctx is cancelled.
+func Every(ctx context.Context, interval time.Duration, run func(ctx context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		run(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drain calls batch with a limit of size until it returns fewer than size, as a short batch means
+// nothing is left, or fails. Sizes below one are treated as one.
+func Drain(ctx context.Context, size int, batch func(ctx context.Context, limit int) (int, error)) error {
+	size = max(size, 1)
+	for {
+		n, err := batch(ctx, size)
+		if err != nil {
+			return err
+		}
+		if n < size || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
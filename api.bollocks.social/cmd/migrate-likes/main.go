@@ -0,0 +1,48 @@
+// Command migrate-likes moves the likes of existing posts from the likes array on each post
+// document into the likes subcollection and sharded like counter.
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+
+	firebase "firebase.google.com/go"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/firestore"
+)
+
+func main() {
+	logger := slog.Default()
+
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	var (
+		likeShards = flags.Int("like-shards", 10, "number of shards each post's like counter is split across, must match the API")
+	)
+
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		logger.Info("Failed to parse flags", "error", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	firebaseApp, err := firebase.NewApp(ctx, nil)
+	if err != nil {
+		logger.Info("failed to create firebase app", "error", err)
+		os.Exit(1)
+	}
+	client, err := firebaseApp.Firestore(ctx)
+	if err != nil {
+		logger.Info("failed to create firestore client", "error", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	service := firestore.NewService(client, firestore.Config{LikeShards: *likeShards})
+	migrated, err := service.MigrateLikes(ctx)
+	if err != nil {
+		logger.Info("failed to migrate likes", "error", err, "migrated", migrated)
+		os.Exit(1)
+	}
+	logger.Info("migrated likes", "posts", migrated)
+}
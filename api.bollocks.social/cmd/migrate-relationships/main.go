@@ -0,0 +1,37 @@
+// Command migrate-relationships moves each user's blocks and mutes from the arrays on their relationships
+// document into a document per relationship.
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	firebase "firebase.google.com/go"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/firestore"
+)
+
+func main() {
+	logger := slog.Default()
+
+	ctx := context.Background()
+	firebaseApp, err := firebase.NewApp(ctx, nil)
+	if err != nil {
+		logger.Info("failed to create firebase app", "error", err)
+		os.Exit(1)
+	}
+	client, err := firebaseApp.Firestore(ctx)
+	if err != nil {
+		logger.Info("failed to create firestore client", "error", err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	service := firestore.NewService(client, firestore.Config{})
+	migrated, err := service.MigrateRelationships(ctx)
+	if err != nil {
+		logger.Info("failed to migrate relationships", "error", err, "migrated", migrated)
+		os.Exit(1)
+	}
+	logger.Info("migrated relationships", "users", migrated)
+}
@@ -0,0 +1,59 @@
+// Package counting keeps the like count stored for each post up to date with its sharded like counter.
+package counting
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/batching"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// metrics are published under "counter" at the expvar endpoint.
+var metrics = expvar.NewMap("counter")
+
+// Store counts the likes of posts.
+type Store interface {
+	// CountLikes counts the posts with up to limit changed like counter shards, returning the number of shards found.
+	CountLikes(ctx context.Context, limit int) (int, error)
+}
+
+type Config struct {
+	// Interval is how often changed posts are counted, and so the most a stored count trails likes by.
+	Interval time.Duration
+	// BatchSize is the number of changed shards counted per query, batches are repeated until none remain.
+	BatchSize int
+}
+
+// Counter periodically counts the likes of posts that have been liked or unliked.
+type Counter struct {
+	logger log.Logger
+	store  Store
+	cfg    Config
+}
+
+func NewCounter(logger log.Logger, store Store, cfg Config) *Counter {
+	return &Counter{
+		logger: logger,
+		store:  store,
+		cfg:    cfg,
+	}
+}
+
+// Run counts changed posts every interval until ctx is cancelled.
+func (c *Counter) Run(ctx context.Context) {
+	batching.Every(ctx, c.cfg.Interval, c.count)
+}
+
+func (c *Counter) count(ctx context.Context) {
+	err := batching.Drain(ctx, c.cfg.BatchSize, func(ctx context.Context, limit int) (int, error) {
+		n, err := c.store.CountLikes(ctx, limit)
+		metrics.Add("shards", int64(n))
+		return n, err
+	})
+	if err != nil && ctx.Err() == nil {
+		metrics.Add("errors", 1)
+		c.logger.Log("failed to count likes", "error", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Package entities finds the hashtags, @mentions and URLs in the content of a post.
+package entities
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	TypeHashtag = "hashtag"
+	TypeMention = "mention"
+	TypeURL     = "url"
+)
+
+// Entity is a span of content with a meaning clients can link to.
+type Entity struct {
+	Type string
+	// Start and End are offsets in Unicode code points into the content, End is exclusive.
+	// UTF16Offsets converts them to the UTF-16 offsets JavaScript clients index strings by.
+	Start int
+	End   int
+	// Value is the lowercased tag without its #, the lowercased handle without its @, or the URL.
+	Value string
+}
+
+var (
+	urlRe     = regexp.MustCompile(`https?://[^\s<>"']+`)
+	hashtagRe = regexp.MustCompile(`#\w+`)
+	// mentionRe matches the handles allowed on profiles.
+	mentionRe = regexp.MustCompile(`@[A-Za-z0-9_]{3,30}`)
+)
+
+// Extract returns the entities in content ordered by their position.
+// Hashtags and mentions within URLs, and mentions within email addresses, are not extracted.
+func Extract(content string) []Entity {
+	var found []span
+	for _, loc := range urlRe.FindAllStringIndex(content, -1) {
+		// Punctuation ending a sentence or closing a bracket is not treated as part of the URL.
+		end := loc[0] + len(strings.TrimRight(content[loc[0]:loc[1]], ".,;:!?)]}"))
+		u, err := url.Parse(content[loc[0]:end])
+		if err != nil || u.Host == "" {
+			continue
+		}
+		found = append(found, span{TypeURL, loc[0], end, u.String()})
+	}
+	for _, loc := range hashtagRe.FindAllStringIndex(content, -1) {
+		if startsWord(content, loc[0]) && !overlaps(found, loc) {
+			found = append(found, span{TypeHashtag, loc[0], loc[1], strings.ToLower(content[loc[0]+1 : loc[1]])})
+		}
+	}
+	for _, loc := range mentionRe.FindAllStringIndex(content, -1) {
+		// A handle followed by more word characters is too long to be a mention.
+		if startsWord(content, loc[0]) && !continuesWord(content, loc[1]) && !overlaps(found, loc) {
+			found = append(found, span{TypeMention, loc[0], loc[1], strings.ToLower(content[loc[0]+1 : loc[1]])})
+		}
+	}
+	slices.SortFunc(found, func(a, b span) int { return a.start - b.start })
+
+	// Convert byte offsets to code points, counting incrementally as spans are ordered.
+	entities := make([]Entity, 0, len(found))
+	offset, runes := 0, 0
+	for _, s := range found {
+		runes += utf8.RuneCountInString(content[offset:s.start])
+		start := runes
+		runes += utf8.RuneCountInString(content[s.start:s.end])
+		offset = s.end
+		entities = append(entities, Entity{Type: s.typ, Start: start, End: runes, Value: s.value})
+	}
+	return entities
+}
+
+// UTF16Offsets returns the offset in UTF-16 code units, as JavaScript strings are indexed, of each code point
+// in content, followed by the length of content, so Start and End can be converted by indexing it.
+func UTF16Offsets(content string) []int {
+	offsets := make([]int, 0, utf8.RuneCountInString(content)+1)
+	n := 0
+	for _, r := range content {
+		offsets = append(offsets, n)
+		n += utf16.RuneLen(r)
+	}
+	return append(offsets, n)
+}
+
+// Hashtags returns the hashtags in content, lowercased, sorted and de-duplicated.
+func Hashtags(content string) []string {
+	return values(content, TypeHashtag, true)
+}
+
+// URLs returns the distinct URLs in content in the order they appear.
+func URLs(content string) []string {
+	return values(content, TypeURL, false)
+}
+
+func values(content, typ string, sorted bool) []string {
+	vals := []string{}
+	for _, e := range Extract(content) {
+		if e.Type == typ && !slices.Contains(vals, e.Value) {
+			vals = append(vals, e.Value)
+		}
+	}
+	if sorted {
+		slices.Sort(vals)
+	}
+	return vals
+}
+
+// span is an entity located by byte offsets.
+type span struct {
+	typ        string
+	start, end int
+	value      string
+}
+
+func overlaps(spans []span, loc []int) bool {
+	return slices.ContainsFunc(spans, func(s span) bool { return loc[0] < s.end && s.start < loc[1] })
+}
+
+// startsWord reports whether the entity at byte offset i is not preceded by a word character.
+func startsWord(content string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(content[:i])
+	return i == 0 || !isWord(r)
+}
+
+// continuesWord reports whether a word character follows byte offset i.
+func continuesWord(content string, i int) bool {
+	r, size := utf8.DecodeRuneInString(content[i:])
+	return size > 0 && isWord(r)
+}
+
+func isWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,136 @@
+package firestore
+
+import (
+	"context"
+	"maps"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// account as it is stored in firestore, keyed by user ID.
+// Roles held here are the local roles store, granted in addition to those in token claims.
+type account struct {
+	Roles     []string   `firestore:"roles"`
+	Banned    bool       `firestore:"banned"`
+	BannedAt  *time.Time `firestore:"banned_at,omitempty"`
+	BannedBy  string     `firestore:"banned_by,omitempty"`
+	BanReason string     `firestore:"ban_reason,omitempty"`
+}
+
+func (a *account) toAPI() *api.Account {
+	return &api.Account{
+		Roles:     a.Roles,
+		Banned:    a.Banned,
+		BannedAt:  a.BannedAt,
+		BanReason: a.BanReason,
+	}
+}
+
+// maxCachedAccounts bounds the accounts cached by GetAccount, expired accounts are dropped once it is reached.
+const maxCachedAccounts = 10_000
+
+// cachedAccount is an account cached by GetAccount until expires.
+type cachedAccount struct {
+	account api.Account
+	expires time.Time
+}
+
+// GetAccount returns a user's account, which is read on every request so is cached for Config.AccountCacheTTL.
+func (s *Service) GetAccount(ctx context.Context, userID string) (*api.Account, error) {
+	if a, ok := s.cachedAccount(userID); ok {
+		return a, nil
+	}
+
+	docSnap, err := s.client.Collection("accounts").Doc(userID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			// Most users have no account document, they have no extra roles and are not banned.
+			s.cacheAccount(userID, &api.Account{})
+			return &api.Account{}, nil
+		}
+		return nil, err
+	}
+
+	var a account
+	if err := docSnap.DataTo(&a); err != nil {
+		return nil, err
+	}
+	s.cacheAccount(userID, a.toAPI())
+	return a.toAPI(), nil
+}
+
+func (s *Service) cachedAccount(userID string) (*api.Account, bool) {
+	s.accountsMu.Lock()
+	defer s.accountsMu.Unlock()
+	c, ok := s.accounts[userID]
+	if !ok || time.Now().After(c.expires) {
+		return nil, false
+	}
+	a := c.account
+	return &a, true
+}
+
+func (s *Service) cacheAccount(userID string, a *api.Account) {
+	if s.cfg.AccountCacheTTL <= 0 {
+		return
+	}
+	s.accountsMu.Lock()
+	defer s.accountsMu.Unlock()
+	now := time.Now()
+	if len(s.accounts) >= maxCachedAccounts {
+		maps.DeleteFunc(s.accounts, func(_ string, c cachedAccount) bool { return now.After(c.expires) })
+		if len(s.accounts) >= maxCachedAccounts {
+			clear(s.accounts)
+		}
+	}
+	s.accounts[userID] = cachedAccount{account: *a, expires: now.Add(s.cfg.AccountCacheTTL)}
+}
+
+// uncacheAccount drops a user's cached account once it has changed, so the change applies on this instance at once.
+func (s *Service) uncacheAccount(userID string) {
+	s.accountsMu.Lock()
+	defer s.accountsMu.Unlock()
+	delete(s.accounts, userID)
+}
+
+func (s *Service) BanUser(ctx context.Context, userID, reason string) (*api.Account, error) {
+	adminID, _ := api.ContextGetUserId(ctx)
+	docRef := s.client.Collection("accounts").Doc(userID)
+	var a account
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(docRef)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return err
+		default:
+			if err := doc.DataTo(&a); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		a.Banned, a.BannedAt, a.BannedBy, a.BanReason = true, &now, adminID, reason
+		return tx.Set(docRef, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.uncacheAccount(userID)
+	return a.toAPI(), nil
+}
+
+func (s *Service) UnbanUser(ctx context.Context, userID string) error {
+	_, err := s.client.Collection("accounts").Doc(userID).Set(ctx, map[string]any{
+		"banned":     false,
+		"banned_at":  firestore.Delete,
+		"banned_by":  firestore.Delete,
+		"ban_reason": firestore.Delete,
+	}, firestore.MergeAll)
+	s.uncacheAccount(userID)
+	return err
+}
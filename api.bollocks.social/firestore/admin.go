@@ -0,0 +1,104 @@
+package firestore
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AdminDeletePost permanently deletes a post regardless of its author. The post is marked deleted first,
+// so it stays withheld and is purged later if the documents about it cannot all be removed now.
+func (s *Service) AdminDeletePost(ctx context.Context, postID string) error {
+	docRef := s.client.Collection("bollocks").Doc(postID)
+	docSnap, err := docRef.Get(ctx)
+	if err != nil {
+		return err
+	}
+	p, err := postFromSnapshot(docSnap)
+	if err != nil {
+		return err
+	}
+	updateTime := docSnap.UpdateTime
+	// Deleting a post its author already deleted is not another event, but deleting a withheld post
+	// is sent to webhooks if it was ever sent to them, as it was when it became withheld.
+	if !p.deleted() {
+		batch := s.client.Batch()
+		batch.Update(docRef, []firestore.Update{{Path: "deleted_at", Value: time.Now()}}, firestore.LastUpdateTime(updateTime))
+		if err := s.queueWebhooks(ctx, batch, api.WebhookEventPostDeleted, p.withheld(), docRef.ID, &p); err != nil {
+			return err
+		}
+		results, err := batch.Commit(ctx)
+		if err != nil {
+			return err
+		}
+		updateTime = results[0].UpdateTime
+	}
+	ok, err := s.purgePost(ctx, docRef, updateTime)
+	if err == nil && !ok {
+		return status.Error(codes.Aborted, "post changed while being deleted")
+	}
+	return err
+}
+
+// ListModeratedPosts returns posts withheld from the feed, either quarantined by moderation or hidden after reports.
+func (s *Service) ListModeratedPosts(ctx context.Context) ([]api.ModeratedPost, error) {
+	bollocks := s.client.Collection("bollocks")
+	var posts []api.ModeratedPost
+	var stored []post
+	seen := make(map[string]bool)
+	for _, query := range []firestore.Query{
+		bollocks.Where("moderation.decision", "==", api.ModerationQuarantined).Limit(100),
+		bollocks.Where("hidden", "==", true).Limit(100),
+	} {
+		docSnaps, err := query.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, docSnap := range docSnaps {
+			if seen[docSnap.Ref.ID] {
+				continue
+			}
+			seen[docSnap.Ref.ID] = true
+
+			p, err := postFromSnapshot(docSnap)
+			if err != nil {
+				return nil, err
+			}
+			if p.deleted() {
+				continue
+			}
+			// Admins see the moderation status of every post, not only their own.
+			base := p.toAPI(docSnap.Ref.ID, "")
+			base.ModerationStatus = p.moderationStatus()
+			posts = append(posts, api.ModeratedPost{
+				Post:        base,
+				Author:      p.Author,
+				Hidden:      p.Hidden,
+				ReportCount: p.ReportCount,
+				Moderation:  p.Moderation.toAPI(),
+			})
+			stored = append(stored, p)
+		}
+	}
+
+	base := make([]api.Post, len(posts))
+	for i := range posts {
+		base[i] = posts[i].Post
+	}
+	if err := s.setLikes(ctx, base, stored); err != nil {
+		return nil, err
+	}
+	for i := range posts {
+		posts[i].Post = base[i]
+	}
+
+	slices.SortFunc(posts, func(a, b api.ModeratedPost) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return posts, nil
+}
@@ -0,0 +1,126 @@
+package firestore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListDrafts returns the caller's drafts and scheduled posts, most recently written first.
+func (s *Service) ListDrafts(ctx context.Context) ([]api.Post, error) {
+	userId, _ := api.ContextGetUserId(ctx)
+
+	query := s.client.Collection("bollocks").Where("author", "==", userId).OrderBy("created_at", firestore.Desc)
+	iter := query.Documents(ctx)
+	var ids []string
+	var stored []post
+	for {
+		docSnap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, err := postFromSnapshot(docSnap)
+		if err != nil {
+			return nil, err
+		}
+		if p.deleted() || p.published() {
+			continue
+		}
+		ids = append(ids, docSnap.Ref.ID)
+		stored = append(stored, p)
+	}
+	return s.toAPIPosts(ctx, ids, stored)
+}
+
+// PublishPost publishes one of the caller's drafts or scheduled posts immediately.
+func (s *Service) PublishPost(ctx context.Context, postID string) (*api.Post, error) {
+	docRef := s.client.Collection("bollocks").Doc(postID)
+	docSnap, err := docRef.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err := postFromSnapshot(docSnap)
+	if err != nil {
+		return nil, err
+	}
+	if p.deleted() {
+		return nil, status.Error(codes.NotFound, "post not found")
+	}
+	userID, _ := api.ContextGetUserId(ctx)
+	if p.Author != userID {
+		return nil, status.Error(codes.PermissionDenied, "not the author")
+	}
+	if p.published() {
+		return nil, status.Error(codes.FailedPrecondition, "post is already published")
+	}
+
+	now := time.Now()
+	if err := s.publish(ctx, docRef, &p, now, docSnap.UpdateTime); err != nil {
+		return nil, err
+	}
+	return s.toAPIPost(ctx, docRef.ID, p)
+}
+
+// PublishDuePosts publishes up to limit scheduled posts due at or before now, returning the number published.
+func (s *Service) PublishDuePosts(ctx context.Context, now time.Time, limit int) (int, error) {
+	// Only scheduled posts have a publish time, it is removed when they are published.
+	query := s.client.Collection("bollocks").Where("publish_at", "<=", now).Limit(limit)
+	docSnaps, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, docSnap := range docSnaps {
+		p, err := postFromSnapshot(docSnap)
+		if err != nil {
+			return published, err
+		}
+		if p.deleted() {
+			continue
+		}
+		// The post is dated when it was due rather than when it was picked up, so it is
+		// not pushed ahead of posts written in the meantime.
+		err = s.publish(ctx, docSnap.Ref, &p, p.PublishAt, docSnap.UpdateTime)
+		// The precondition skips posts edited, published or deleted since the query,
+		// those still due are picked up by the next run.
+		if status.Code(err) == codes.FailedPrecondition || status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// publish publishes a post dated publishedAt, provided it has not been written since lastUpdateTime,
+// and notifies the users it mentions.
+func (s *Service) publish(ctx context.Context, docRef *firestore.DocumentRef, p *post, publishedAt, lastUpdateTime time.Time) error {
+	p.Status, p.PublishAt, p.CreatedAt, p.PublishedAt = api.PostStatusPublished, time.Time{}, publishedAt, time.Now()
+	batch := s.client.Batch()
+	batch.Update(docRef, []firestore.Update{
+		{Path: "status", Value: api.PostStatusPublished},
+		{Path: "publish_at", Value: firestore.Delete},
+		{Path: "created_at", Value: publishedAt},
+		{Path: "published_at", Value: p.PublishedAt},
+		p.versionUpdate(),
+	}, firestore.LastUpdateTime(lastUpdateTime))
+	if err := s.notifyMentions(ctx, batch, docRef.ID, p, nil); err != nil {
+		return err
+	}
+	if err := s.queueWebhooks(ctx, batch, api.WebhookEventPostCreated, true, docRef.ID, p); err != nil {
+		return err
+	}
+	_, err := batch.Commit(ctx)
+	return err
+}
@@ -0,0 +1,78 @@
+package firestore
+
+import (
+	"context"
+	"slices"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/entities"
+)
+
+// entity as it is stored on a post.
+type entity struct {
+	Type  string `firestore:"type"`
+	Start int    `firestore:"start"`
+	End   int    `firestore:"end"`
+	Value string `firestore:"value"`
+	// UserID is the user a mention resolved to, it is not exposed to clients.
+	UserID string `firestore:"user_id,omitempty"`
+}
+
+// toAPI maps the entity to the API, where utf16 holds the UTF-16 offset of each code point in the content.
+// Entities stored in code points are converted when read, so those of existing posts have UTF-16 offsets too.
+func (e entity) toAPI(utf16 []int) api.Entity {
+	last := len(utf16) - 1
+	return api.Entity{
+		Type:       e.Type,
+		Start:      e.Start,
+		End:        e.End,
+		StartUTF16: utf16[min(e.Start, last)],
+		EndUTF16:   utf16[min(e.End, last)],
+		Value:      e.Value,
+	}
+}
+
+// resolveEntities returns entities to store on a post, resolving mentions to the users
+// holding their handles. Mentions of handles nobody holds are dropped.
+func (s *Service) resolveEntities(ctx context.Context, ents []api.Entity) ([]entity, error) {
+	var refs []*firestore.DocumentRef
+	for _, e := range ents {
+		if e.Type != entities.TypeMention {
+			continue
+		}
+		ref := s.client.Collection("handles").Doc(e.Value)
+		if !slices.ContainsFunc(refs, func(r *firestore.DocumentRef) bool { return r.ID == ref.ID }) {
+			refs = append(refs, ref)
+		}
+	}
+	userIDs := make(map[string]string, len(refs))
+	if len(refs) > 0 {
+		docSnaps, err := s.client.GetAll(ctx, refs)
+		if err != nil {
+			return nil, err
+		}
+		for _, docSnap := range docSnaps {
+			if !docSnap.Exists() {
+				continue
+			}
+			var h handle
+			if err := docSnap.DataTo(&h); err != nil {
+				return nil, err
+			}
+			userIDs[docSnap.Ref.ID] = h.UserID
+		}
+	}
+
+	stored := make([]entity, 0, len(ents))
+	for _, e := range ents {
+		se := entity{Type: e.Type, Start: e.Start, End: e.End, Value: e.Value}
+		if e.Type == entities.TypeMention {
+			if se.UserID = userIDs[e.Value]; se.UserID == "" {
+				continue
+			}
+		}
+		stored = append(stored, se)
+	}
+	return stored, nil
+}
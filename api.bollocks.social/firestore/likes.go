@@ -0,0 +1,482 @@
+package firestore
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Likes are stored as a document per liker in the post's "likes" subcollection, keyed by user ID,
+// and counted by a sharded counter in its "like_shards" subcollection so popular posts
+// neither outgrow the document size limit nor contend on a single counter. CountLikes sums
+// changed counters into the "like_counts" collection, keyed by post ID, so lists of posts
+// read a single count per post rather than every shard.
+
+// like as it is stored in firestore.
+type like struct {
+	CreatedAt time.Time `firestore:"created_at"`
+}
+
+// likeShard is one shard of a post's like count, the count is the sum of all shards.
+// Counted is cleared by every change to the shard and set once the change is included
+// in the post's like count.
+type likeShard struct {
+	Count     int       `firestore:"count"`
+	UpdatedAt time.Time `firestore:"updated_at,serverTimestamp"`
+	Counted   bool      `firestore:"counted"`
+}
+
+// likeCount is the total of a post's like counter and legacy likes, as of when it was last counted.
+type likeCount struct {
+	Count     int       `firestore:"count"`
+	UpdatedAt time.Time `firestore:"updated_at,serverTimestamp"`
+}
+
+// likeShard returns a random shard of the like counter for a post.
+func (s *Service) likeShard(postRef *firestore.DocumentRef) *firestore.DocumentRef {
+	return postRef.Collection("like_shards").Doc(strconv.Itoa(rand.IntN(s.likeShards())))
+}
+
+// shardIncrement is the update adding n to a shard of a like counter, marking it to be counted.
+func shardIncrement(n int) map[string]any {
+	return map[string]any{"count": firestore.Increment(n), "updated_at": firestore.ServerTimestamp, "counted": false}
+}
+
+func (s *Service) likeCountRef(postID string) *firestore.DocumentRef {
+	return s.client.Collection("like_counts").Doc(postID)
+}
+
+func (s *Service) likeShards() int {
+	return max(s.cfg.LikeShards, 1)
+}
+
+func (s *Service) ToggleLike(ctx context.Context, postID string) (*api.Post, error) {
+	return s.setLike(ctx, postID, nil)
+}
+
+// LikePost likes a post on behalf of the caller, doing nothing if they already like it.
+func (s *Service) LikePost(ctx context.Context, postID string) (*api.Post, error) {
+	like := true
+	return s.setLike(ctx, postID, &like)
+}
+
+// UnlikePost removes the caller's like from a post, doing nothing if they do not like it.
+func (s *Service) UnlikePost(ctx context.Context, postID string) (*api.Post, error) {
+	like := false
+	return s.setLike(ctx, postID, &like)
+}
+
+// setLike sets whether the caller likes a post, toggling it if liked is nil.
+func (s *Service) setLike(ctx context.Context, postID string, liked *bool) (*api.Post, error) {
+	userId, _ := api.ContextGetUserId(ctx)
+	docRef := s.client.Collection("bollocks").Doc(postID)
+	likeRef := docRef.Collection("likes").Doc(userId)
+	var p post
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		if p, err = postFromSnapshot(doc); err != nil {
+			return err
+		}
+		// Posts withheld from the caller cannot be liked, as GetPost does not find them.
+		if p.deleted() || (p.withheld() && p.Author != userId) {
+			return status.Error(codes.NotFound, "post not found")
+		}
+		_, err = tx.Get(likeRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		hasLike := err == nil
+		hasLegacyLike := slices.Contains(p.LegacyLikes, userId)
+
+		isCurrentlyLiked := hasLike || hasLegacyLike
+		want := !isCurrentlyLiked
+		if liked != nil {
+			want = *liked
+		}
+
+		switch {
+		case want == isCurrentlyLiked:
+			return nil
+		case isCurrentlyLiked:
+			// Legacy likes are counted by the length of the array, so removing them needs no shard update.
+			if hasLegacyLike {
+				if err := tx.Update(docRef, []firestore.Update{{Path: "likes", Value: firestore.ArrayRemove(userId)}}); err != nil {
+					return err
+				}
+			}
+			if hasLike {
+				if err := tx.Delete(likeRef); err != nil {
+					return err
+				}
+				return tx.Set(s.likeShard(docRef), shardIncrement(-1), firestore.MergeAll)
+			}
+			// The counter is marked as changed so the post is counted again.
+			return tx.Set(s.likeShard(docRef), shardIncrement(0), firestore.MergeAll)
+		default:
+			// Blocked users can still take back a like, but not add one.
+			rel, err := s.checkNotBlocked(tx, &p, userId)
+			if err != nil {
+				return err
+			}
+			if p.Author != userId {
+				if err := s.notifyLike(tx, rel, p.Author, docRef.ID, userId); err != nil {
+					return err
+				}
+			}
+			if err := s.queueWebhooksTx(ctx, tx, api.WebhookEventPostLiked, p.withheld(), docRef.ID, &p); err != nil {
+				return err
+			}
+			if err := tx.Create(likeRef, like{CreatedAt: time.Now()}); err != nil {
+				return err
+			}
+			return tx.Set(s.likeShard(docRef), shardIncrement(1), firestore.MergeAll)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The transaction does not read the counter shards, so the count read here
+	// may include concurrent likes by other users.
+	p.LegacyLikes = slices.DeleteFunc(p.LegacyLikes, func(id string) bool { return id == userId })
+	return s.toAPIPost(ctx, docRef.ID, p)
+}
+
+// setLikes sets the like count of each post, and whether the caller likes it, where stored holds the post at the same index.
+// Lists of posts take their counts from like_counts, which trail likes by up to the counting interval. A single post,
+// or one not counted yet, is summed from its shards so that callers see their own likes at once.
+func (s *Service) setLikes(ctx context.Context, posts []api.Post, stored []post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	userId, _ := api.ContextGetUserId(ctx)
+	bollocks := s.client.Collection("bollocks")
+	counted := len(posts) > 1
+
+	// Fetch the caller's like of every post, then the count of every post, in a single round trip.
+	refs := make([]*firestore.DocumentRef, 0, 2*len(posts))
+	for _, post := range posts {
+		refs = append(refs, bollocks.Doc(post.ID).Collection("likes").Doc(userId))
+	}
+	if counted {
+		for _, post := range posts {
+			refs = append(refs, s.likeCountRef(post.ID))
+		}
+	}
+	docSnaps, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		return err
+	}
+
+	var uncounted []int
+	for i := range posts {
+		posts[i].LikedByMe = docSnaps[i].Exists() || slices.Contains(stored[i].LegacyLikes, userId)
+		if !counted || !docSnaps[len(posts)+i].Exists() {
+			uncounted = append(uncounted, i)
+			continue
+		}
+		var c likeCount
+		if err := docSnaps[len(posts)+i].DataTo(&c); err != nil {
+			return err
+		}
+		posts[i].Likes = c.Count
+	}
+	return s.sumLikes(ctx, posts, stored, uncounted)
+}
+
+// sumLikes sets the like count of the posts at the given indexes from their shards and legacy likes.
+func (s *Service) sumLikes(ctx context.Context, posts []api.Post, stored []post, indexes []int) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+	bollocks := s.client.Collection("bollocks")
+	shards := s.likeShards()
+
+	refs := make([]*firestore.DocumentRef, 0, len(indexes)*shards)
+	for _, i := range indexes {
+		postRef := bollocks.Doc(posts[i].ID)
+		for shard := range shards {
+			refs = append(refs, postRef.Collection("like_shards").Doc(strconv.Itoa(shard)))
+		}
+	}
+	docSnaps, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		return err
+	}
+
+	for n, i := range indexes {
+		count := len(stored[i].LegacyLikes)
+		for _, docSnap := range docSnaps[n*shards : (n+1)*shards] {
+			if !docSnap.Exists() {
+				continue
+			}
+			var shard likeShard
+			if err := docSnap.DataTo(&shard); err != nil {
+				return err
+			}
+			count += shard.Count
+		}
+		posts[i].Likes = count
+	}
+	return nil
+}
+
+// CountLikes updates the like counts of the posts with changed counter shards, finding up to limit
+// changed shards and returning the number found. The shards are found by a collection group query on
+// their counted field, which needs the single-field collection group index on that field.
+func (s *Service) CountLikes(ctx context.Context, limit int) (int, error) {
+	docSnaps, err := s.client.CollectionGroup("like_shards").Where("counted", "==", false).Limit(limit).Select().Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	// Several shards of the same post may have changed.
+	counted := make(map[string]bool)
+	for _, docSnap := range docSnaps {
+		postRef := docSnap.Ref.Parent.Parent
+		if counted[postRef.ID] {
+			continue
+		}
+		if err := s.countPostLikes(ctx, postRef); err != nil {
+			return 0, err
+		}
+		counted[postRef.ID] = true
+	}
+	return len(docSnaps), nil
+}
+
+// countPostLikes sums a post's shards and legacy likes into its like count, marking the shards as counted.
+// Every shard that exists is summed, not only those below the configured number, so a counter written
+// with more shards than the service now uses is still counted rather than found changed on every run.
+// Likes made while it runs either abort it, or mark their shard to be counted again.
+func (s *Service) countPostLikes(ctx context.Context, postRef *firestore.DocumentRef) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		postSnap, err := tx.Get(postRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		postExists := err == nil
+		shardSnaps, err := tx.Documents(postRef.Collection("like_shards")).GetAll()
+		if err != nil {
+			return err
+		}
+		count := 0
+		if postExists {
+			p, err := postFromSnapshot(postSnap)
+			if err != nil {
+				return err
+			}
+			count = len(p.LegacyLikes)
+		}
+		for _, docSnap := range shardSnaps {
+			var shard likeShard
+			if err := docSnap.DataTo(&shard); err != nil {
+				return err
+			}
+			count += shard.Count
+			if !shard.Counted {
+				if err := tx.Update(docSnap.Ref, []firestore.Update{{Path: "counted", Value: true}}); err != nil {
+					return err
+				}
+			}
+		}
+		// The shards of a purged post are marked as counted, they are about to be removed with it.
+		if !postExists {
+			return nil
+		}
+		return tx.Set(s.likeCountRef(postRef.ID), likeCount{Count: count})
+	})
+}
+
+// ListLikes returns a page of the public profiles of users who like a post, in the order they liked it.
+// Likes of posts not yet migrated from the legacy likes array are not listed.
+// The cursor is opaque to clients and empty for the first page.
+func (s *Service) ListLikes(ctx context.Context, postID, cursor string, limit int) (*api.LikesPage, error) {
+	postRef := s.client.Collection("bollocks").Doc(postID)
+	docSnap, err := postRef.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err := postFromSnapshot(docSnap)
+	if err != nil {
+		return nil, err
+	}
+	if p.deleted() || p.withheld() {
+		return nil, status.Error(codes.NotFound, "post not found")
+	}
+
+	query := postRef.Collection("likes").OrderBy("created_at", firestore.Asc).OrderBy(firestore.DocumentID, firestore.Asc)
+	if cursor != "" {
+		createdAt, userID, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid cursor")
+		}
+		query = query.StartAfter(createdAt, userID)
+	}
+	// Fetch one more than requested to know whether there is another page.
+	docSnaps, err := query.Limit(limit + 1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &api.LikesPage{Likers: make([]api.Author, 0, min(len(docSnaps), limit))}
+	if len(docSnaps) > limit {
+		docSnaps = docSnaps[:limit]
+		var last like
+		if err := docSnaps[limit-1].DataTo(&last); err != nil {
+			return nil, err
+		}
+		page.NextCursor = encodeCursor(last.CreatedAt, docSnaps[limit-1].Ref.ID)
+	}
+
+	userIDs := make([]string, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		// Posts are liked by their author when created, listing that like would reveal who wrote an anonymous post.
+		if p.Anonymous && docSnap.Ref.ID == p.Author {
+			continue
+		}
+		userIDs = append(userIDs, docSnap.Ref.ID)
+	}
+	authors, err := s.getAuthors(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range userIDs {
+		// Users without a public profile are still counted but shown without details.
+		var a api.Author
+		if author, ok := authors[id]; ok {
+			a = *author
+		}
+		page.Likers = append(page.Likers, a)
+	}
+	return page, nil
+}
+
+// encodeCursor encodes the position of a document in a page ordered by a time and then document ID,
+// as likes and notifications are.
+func encodeCursor(t time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(t.UnixNano(), 10) + ":" + id))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	nanos, id, _ := strings.Cut(string(b), ":")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return time.Unix(0, n), id, nil
+}
+
+// migrateLikesChunk is the number of legacy likes moved per transaction, keeping within the write limit.
+const migrateLikesChunk = 400
+
+// MigrateLikes moves every post's legacy likes array into its likes subcollection and counter,
+// returning the number of posts migrated. It is safe to re-run, and to run while the service is
+// serving traffic, as each chunk of likes is moved and counted in the same transaction.
+func (s *Service) MigrateLikes(ctx context.Context) (int, error) {
+	docRefs, err := s.client.Collection("bollocks").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, docRef := range docRefs {
+		moved, err := s.migratePostLikes(ctx, docRef)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate likes of post %s: %w", docRef.ID, err)
+		}
+		if moved {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+func (s *Service) migratePostLikes(ctx context.Context, docRef *firestore.DocumentRef) (bool, error) {
+	moved := false
+	for {
+		done := false
+		err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			doc, err := tx.Get(docRef)
+			if status.Code(err) == codes.NotFound {
+				done = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := doc.DataAt("likes"); err != nil {
+				// Already migrated, or created after likes moved to the subcollection.
+				done = true
+				return nil
+			}
+			var p post
+			if err := doc.DataTo(&p); err != nil {
+				return err
+			}
+			if len(p.LegacyLikes) == 0 {
+				done = true
+				if err := tx.Update(docRef, []firestore.Update{{Path: "likes", Value: firestore.Delete}}); err != nil {
+					return err
+				}
+				// The counter is marked as changed so the post is counted.
+				return tx.Set(s.likeShard(docRef), shardIncrement(0), firestore.MergeAll)
+			}
+
+			chunk := p.LegacyLikes[:min(len(p.LegacyLikes), migrateLikesChunk)]
+			likeRefs := make([]*firestore.DocumentRef, 0, len(chunk))
+			for _, userID := range chunk {
+				likeRefs = append(likeRefs, docRef.Collection("likes").Doc(userID))
+			}
+			likeSnaps, err := tx.GetAll(likeRefs)
+			if err != nil {
+				return err
+			}
+
+			// Users may have liked the post again since the subcollection was introduced,
+			// those likes are already counted.
+			created := 0
+			for _, likeSnap := range likeSnaps {
+				if likeSnap.Exists() {
+					continue
+				}
+				if err := tx.Create(likeSnap.Ref, like{CreatedAt: p.CreatedAt}); err != nil {
+					return err
+				}
+				created++
+			}
+			elems := make([]any, 0, len(chunk))
+			for _, userID := range chunk {
+				elems = append(elems, userID)
+			}
+			if err := tx.Update(docRef, []firestore.Update{{Path: "likes", Value: firestore.ArrayRemove(elems...)}}); err != nil {
+				return err
+			}
+			if created == 0 {
+				return nil
+			}
+			return tx.Set(s.likeShard(docRef), shardIncrement(created), firestore.MergeAll)
+		})
+		if err != nil || done {
+			return moved, err
+		}
+		moved = true
+	}
+}
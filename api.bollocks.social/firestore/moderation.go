@@ -0,0 +1,55 @@
+package firestore
+
+import (
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+)
+
+// moderation verdict as it is stored on a post.
+type moderation struct {
+	Decision  string             `firestore:"decision"`
+	Reason    string             `firestore:"reason,omitempty"`
+	Scores    map[string]float64 `firestore:"scores,omitempty"`
+	CheckedAt time.Time          `firestore:"checked_at"`
+}
+
+func toModeration(m *api.Moderation) *moderation {
+	if m == nil {
+		return nil
+	}
+	return &moderation{
+		Decision:  m.Decision,
+		Reason:    m.Reason,
+		Scores:    m.Scores,
+		CheckedAt: m.CheckedAt,
+	}
+}
+
+// moderationStatus returns the decision recorded on a post, empty if it was never moderated.
+func (p *post) moderationStatus() string {
+	if p.Hidden {
+		return api.ModerationHidden
+	}
+	if p.Moderation == nil {
+		return ""
+	}
+	return p.Moderation.Decision
+}
+
+// withheld reports whether a post must be withheld from other users, either by moderation or because it is unpublished.
+func (p *post) withheld() bool {
+	return p.Hidden || p.moderationStatus() == api.ModerationQuarantined || !p.published()
+}
+
+func (m *moderation) toAPI() *api.Moderation {
+	if m == nil {
+		return nil
+	}
+	return &api.Moderation{
+		Decision:  m.Decision,
+		Reason:    m.Reason,
+		Scores:    m.Scores,
+		CheckedAt: m.CheckedAt,
+	}
+}
@@ -0,0 +1,268 @@
+package firestore
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Notifications are aggregated into one document per recipient, type and post, so repeated
+// likes of a post become a single "n people liked your post" notification.
+
+// maxNotificationActors is the number of most recent actors kept on a notification, older actors are only counted.
+const maxNotificationActors = 10
+
+// notification as it is stored in firestore.
+type notification struct {
+	Recipient string `firestore:"recipient"`
+	Type      string `firestore:"type"`
+	PostID    string `firestore:"post_id"`
+	// Actors holds the user IDs of the most recent actors first, it is empty for actions by anonymous posts.
+	Actors     []string  `firestore:"actors"`
+	ActorCount int       `firestore:"actor_count"`
+	Read       bool      `firestore:"read"`
+	CreatedAt  time.Time `firestore:"created_at"`
+	UpdatedAt  time.Time `firestore:"updated_at"`
+}
+
+func (s *Service) notificationRef(recipient, typ, postID string) *firestore.DocumentRef {
+	return s.client.Collection("notifications").Doc(recipient + "_" + typ + "_" + postID)
+}
+
+// notifyLike records that actor liked the recipient's post, where rel is the recipient's relationship with actor.
+// It reads within tx, so must be called before tx writes. Like mentions, likes are not notified if the
+// recipient has blocked or muted the actor, and an actor among the recent actors is not counted twice,
+// so liking a post again after un-liking it is not notified.
+func (s *Service) notifyLike(tx *firestore.Transaction, rel relationship, recipient, postID, actor string) error {
+	if rel.excludes() {
+		return nil
+	}
+	ref := s.notificationRef(recipient, api.NotificationLike, postID)
+	doc, err := tx.Get(ref)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return err
+	}
+	now := time.Now()
+	n := notification{Recipient: recipient, Type: api.NotificationLike, PostID: postID, CreatedAt: now}
+	if err == nil {
+		if err := doc.DataTo(&n); err != nil {
+			return err
+		}
+		if slices.Contains(n.Actors, actor) {
+			return nil
+		}
+	}
+	n.Actors = slices.Insert(n.Actors, 0, actor)
+	n.Actors = n.Actors[:min(len(n.Actors), maxNotificationActors)]
+	n.ActorCount++
+	n.Read, n.UpdatedAt = false, now
+	return tx.Set(ref, n)
+}
+
+// notifyMentions adds a notification to batch for each user newly mentioned by a post, where previous holds
+// the post's entities before it was written. Nobody is notified until the post is visible to other users,
+// nor if they have blocked or muted its author.
+func (s *Service) notifyMentions(ctx context.Context, batch *firestore.WriteBatch, postID string, p *post, previous []entity) error {
+	if p.deleted() || p.withheld() {
+		return nil
+	}
+	var recipients []string
+	for _, e := range p.Entities {
+		if e.UserID == "" || e.UserID == p.Author || slices.Contains(recipients, e.UserID) {
+			continue
+		}
+		if slices.ContainsFunc(previous, func(prev entity) bool { return prev.UserID == e.UserID }) {
+			continue
+		}
+		recipients = append(recipients, e.UserID)
+	}
+
+	now := time.Now()
+	for _, recipient := range recipients {
+		// Mentions from users the recipient blocked or muted are left out even on anonymous posts,
+		// as only the recipient could tell and they already know who they excluded.
+		rel, err := s.getRelationship(ctx, recipient, p.Author)
+		if err != nil {
+			return err
+		}
+		if rel.excludes() {
+			continue
+		}
+		n := notification{
+			Recipient:  recipient,
+			Type:       api.NotificationMention,
+			PostID:     postID,
+			Actors:     []string{},
+			ActorCount: 1,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		if author := p.publicAuthor(); author != "" {
+			n.Actors = []string{author}
+		}
+		batch.Set(s.notificationRef(recipient, api.NotificationMention, postID), n)
+	}
+	return nil
+}
+
+// ListNotifications returns a page of the caller's notifications, most recently updated first.
+// The cursor is opaque to clients and empty for the first page.
+func (s *Service) ListNotifications(ctx context.Context, cursor string, limit int) (*api.NotificationsPage, error) {
+	userID, _ := api.ContextGetUserId(ctx)
+	col := s.client.Collection("notifications")
+	query := col.Where("recipient", "==", userID).OrderBy("updated_at", firestore.Desc).OrderBy(firestore.DocumentID, firestore.Desc)
+	if cursor != "" {
+		updatedAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid cursor")
+		}
+		query = query.StartAfter(updatedAt, col.Doc(id))
+	}
+	// Fetch one more than requested to know whether there is another page.
+	docSnaps, err := query.Limit(limit + 1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	unread, err := s.unreadNotifications(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	page := &api.NotificationsPage{UnreadCount: unread}
+	if len(docSnaps) > limit {
+		docSnaps = docSnaps[:limit]
+		last := docSnaps[limit-1]
+		updatedAt, err := last.DataAt("updated_at")
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = encodeCursor(updatedAt.(time.Time), last.Ref.ID)
+	}
+
+	ids := make([]string, 0, len(docSnaps))
+	stored := make([]notification, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		var n notification
+		if err := docSnap.DataTo(&n); err != nil {
+			return nil, err
+		}
+		ids = append(ids, docSnap.Ref.ID)
+		stored = append(stored, n)
+	}
+	if page.Notifications, err = s.toAPINotifications(ctx, ids, stored); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// toAPINotifications maps stored notifications to the API, where ids holds the ID of the notification at the same index.
+func (s *Service) toAPINotifications(ctx context.Context, ids []string, stored []notification) ([]api.Notification, error) {
+	var actors []string
+	for _, n := range stored {
+		for _, actor := range n.Actors {
+			if !slices.Contains(actors, actor) {
+				actors = append(actors, actor)
+			}
+		}
+	}
+	authors, err := s.getAuthors(ctx, actors)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := make([]api.Notification, 0, len(stored))
+	for i, n := range stored {
+		notification := api.Notification{
+			ID:         ids[i],
+			Type:       n.Type,
+			PostID:     n.PostID,
+			Actors:     make([]api.Author, 0, len(n.Actors)),
+			ActorCount: n.ActorCount,
+			Read:       n.Read,
+			CreatedAt:  n.CreatedAt,
+			UpdatedAt:  n.UpdatedAt,
+		}
+		for _, actor := range n.Actors {
+			// Users without a public profile are still counted but shown without details.
+			var a api.Author
+			if author, ok := authors[actor]; ok {
+				a = *author
+			}
+			notification.Actors = append(notification.Actors, a)
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, nil
+}
+
+func (s *Service) unreadNotifications(ctx context.Context, userID string) (int, error) {
+	query := s.client.Collection("notifications").Where("recipient", "==", userID).Where("read", "==", false)
+	result, err := query.NewAggregationQuery().WithCount("unread").Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := result["unread"].(*firestorepb.Value)
+	if !ok {
+		return 0, errors.New("unread count missing from aggregation result")
+	}
+	return int(count.GetIntegerValue()), nil
+}
+
+// MarkNotificationRead marks one of the caller's notifications as read.
+func (s *Service) MarkNotificationRead(ctx context.Context, notificationID string) error {
+	userID, _ := api.ContextGetUserId(ctx)
+	docRef := s.client.Collection("notifications").Doc(notificationID)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docSnap, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		var n notification
+		if err := docSnap.DataTo(&n); err != nil {
+			return err
+		}
+		// Other users' notifications are not revealed.
+		if n.Recipient != userID {
+			return status.Error(codes.NotFound, "notification not found")
+		}
+		if n.Read {
+			return nil
+		}
+		return tx.Update(docRef, []firestore.Update{{Path: "read", Value: true}})
+	})
+}
+
+// MarkAllNotificationsRead marks all of the caller's notifications as read.
+func (s *Service) MarkAllNotificationsRead(ctx context.Context) error {
+	userID, _ := api.ContextGetUserId(ctx)
+	query := s.client.Collection("notifications").Where("recipient", "==", userID).Where("read", "==", false)
+	docSnaps, err := query.Select().Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	bw := s.client.BulkWriter(ctx)
+	jobs := make([]*firestore.BulkWriterJob, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		job, err := bw.Update(docSnap.Ref, []firestore.Update{{Path: "read", Value: true}})
+		if err != nil {
+			bw.End()
+			return err
+		}
+		jobs = append(jobs, job)
+	}
+	bw.End()
+	// Updates are retried by the BulkWriter, so an error here is one it gave up on.
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
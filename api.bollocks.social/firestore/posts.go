@@ -0,0 +1,266 @@
+package firestore
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/entities"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// post as it is stored in firestore.
+// id is not included as it is part of the document reference.
+type post struct {
+	Bollocks string   `firestore:"bollocks"`
+	Tags     []string `firestore:"tags"`
+	// Attachments is empty for text-only posts.
+	Attachments  []attachment  `firestore:"attachments,omitempty"`
+	LinkPreviews []linkPreview `firestore:"link_previews,omitempty"`
+	// Entities is empty for posts written before entities were extracted.
+	Entities []entity `firestore:"entities,omitempty"`
+	// TagsStatus is empty for posts written before tags could be generated asynchronously.
+	TagsStatus string `firestore:"tags_status"`
+	Author     string `firestore:"author"`
+	// CreatedAt is when the post was published, or written while it is unpublished.
+	CreatedAt time.Time `firestore:"created_at"`
+	// Status is empty for posts written before drafts, they are published.
+	Status string `firestore:"status"`
+	// PublishAt is when a scheduled post is due to be published, it is removed once it has been.
+	PublishAt time.Time `firestore:"publish_at,omitempty"`
+	// PublishedAt is when the post was actually published, unlike CreatedAt which for scheduled posts
+	// is when they were due. It is zero for unpublished posts and those published before it was recorded.
+	PublishedAt time.Time `firestore:"published_at,omitempty"`
+	// UpdatedAt is zero for posts written before it was recorded, they are treated as never updated.
+	UpdatedAt time.Time `firestore:"updated_at"`
+	Edited    bool      `firestore:"edited"`
+	// EditedAt is when the content was last changed, zero if it never has been.
+	EditedAt time.Time `firestore:"edited_at,omitempty"`
+	// LegacyLikes holds the likers of posts not yet migrated to the likes subcollection,
+	// it is no longer written and emptied by cmd/migrate-likes.
+	LegacyLikes []string `firestore:"likes,omitempty"`
+	// Moderation is nil for posts written while moderation was disabled.
+	Moderation *moderation `firestore:"moderation,omitempty"`
+	// ReportCount is the number of times the post has been reported since it was last restored.
+	ReportCount int `firestore:"report_count"`
+	// Hidden is set once a post has been reported too many times, or removed by an admin.
+	Hidden    bool `firestore:"hidden"`
+	Anonymous bool `firestore:"anonymous"`
+	// DeletedAt is set when the author deletes the post, it is purged once the retention period has passed.
+	DeletedAt time.Time `firestore:"deleted_at,omitempty"`
+	// Purging is set once a deleted post is being purged, it can no longer be restored.
+	Purging bool `firestore:"purging,omitempty"`
+	// Version is incremented by every change the author makes to the post: editing, publishing, deleting and
+	// restoring it. Writes made about it in the background, such as its tags or reports, leave it unchanged,
+	// so they do not invalidate the version an author edits against. It is zero for posts written before it.
+	Version int64 `firestore:"version"`
+}
+
+// publicAuthor returns the author whose profile may be shown on the post, empty for anonymous posts.
+func (p *post) publicAuthor() string {
+	if p.Anonymous {
+		return ""
+	}
+	return p.Author
+}
+
+// deleted reports whether the author has deleted the post, it is withheld from everyone until purged.
+func (p *post) deleted() bool {
+	return !p.DeletedAt.IsZero()
+}
+
+// attachment as it is stored on a post.
+type attachment struct {
+	ID           string `firestore:"id"`
+	ContentType  string `firestore:"content_type"`
+	Size         int64  `firestore:"size"`
+	Width        int    `firestore:"width"`
+	Height       int    `firestore:"height"`
+	URL          string `firestore:"url"`
+	ThumbnailURL string `firestore:"thumbnail_url"`
+}
+
+func toAttachments(attachments []api.Attachment) []attachment {
+	if attachments == nil {
+		return nil
+	}
+	stored := make([]attachment, 0, len(attachments))
+	for _, a := range attachments {
+		stored = append(stored, attachment(a))
+	}
+	return stored
+}
+
+func (a attachment) toAPI() api.Attachment {
+	return api.Attachment(a)
+}
+
+// linkPreview as it is stored on a post.
+type linkPreview struct {
+	URL         string `firestore:"url"`
+	Title       string `firestore:"title"`
+	Description string `firestore:"description"`
+	ImageURL    string `firestore:"image_url"`
+	SiteName    string `firestore:"site_name"`
+}
+
+func toLinkPreviews(previews []api.LinkPreview) []linkPreview {
+	stored := make([]linkPreview, 0, len(previews))
+	for _, l := range previews {
+		stored = append(stored, linkPreview(l))
+	}
+	return stored
+}
+
+// published reports whether the post has been published, rather than being a draft or scheduled.
+func (p *post) published() bool {
+	return p.Status == "" || p.Status == api.PostStatusPublished
+}
+
+// toAPI maps the fields held on the post document to the API representation seen by userID.
+// Fields held in other documents are set by decorate.
+func (p *post) toAPI(id, userID string) api.Post {
+	updatedAt := p.UpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = p.CreatedAt
+	}
+	post := api.Post{
+		ID:          id,
+		Bollocks:    p.Bollocks,
+		Tags:        p.Tags,
+		Attachments: make([]api.Attachment, 0, len(p.Attachments)),
+		Entities:    make([]api.Entity, 0, len(p.Entities)),
+		TagsStatus:  p.TagsStatus,
+		Status:      api.PostStatusPublished,
+		CreatedAt:   p.CreatedAt,
+		UpdatedAt:   updatedAt,
+		Edited:      p.Edited,
+		Anonymous:   p.Anonymous,
+		IsMine:      p.Author == userID,
+		Version:     strconv.FormatInt(p.Version, 10),
+	}
+	for _, a := range p.Attachments {
+		post.Attachments = append(post.Attachments, a.toAPI())
+	}
+	if len(p.Entities) > 0 {
+		offsets := entities.UTF16Offsets(p.Bollocks)
+		for _, e := range p.Entities {
+			post.Entities = append(post.Entities, e.toAPI(offsets))
+		}
+	}
+	for _, l := range p.LinkPreviews {
+		post.LinkPreviews = append(post.LinkPreviews, api.LinkPreview(l))
+	}
+	if !p.published() {
+		post.Status = p.Status
+	}
+	if !p.PublishAt.IsZero() {
+		publishAt := p.PublishAt
+		post.PublishAt = &publishAt
+	}
+	if !p.EditedAt.IsZero() {
+		editedAt := p.EditedAt
+		post.EditedAt = &editedAt
+	}
+	if post.IsMine {
+		post.ModerationStatus = p.moderationStatus()
+	}
+	return post
+}
+
+// postFromSnapshot decodes a post document.
+func postFromSnapshot(docSnap *firestore.DocumentSnapshot) (post, error) {
+	var p post
+	err := docSnap.DataTo(&p)
+	return p, err
+}
+
+// versionUpdate returns the update incrementing the version of p, and increments it on p to match.
+func (p *post) versionUpdate() firestore.Update {
+	p.Version++
+	return firestore.Update{Path: "version", Value: firestore.Increment(1)}
+}
+
+// toAPIPosts maps stored posts to the API representation seen by the caller,
+// where ids holds the document ID of the post at the same index.
+func (s *Service) toAPIPosts(ctx context.Context, ids []string, stored []post) ([]api.Post, error) {
+	userID, _ := api.ContextGetUserId(ctx)
+	posts := make([]api.Post, len(stored))
+	for i := range stored {
+		posts[i] = stored[i].toAPI(ids[i], userID)
+	}
+	if err := s.decorate(ctx, posts, stored); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// toAPIPost maps a single stored post to the API representation seen by the caller.
+func (s *Service) toAPIPost(ctx context.Context, id string, p post) (*api.Post, error) {
+	posts, err := s.toAPIPosts(ctx, []string{id}, []post{p})
+	if err != nil {
+		return nil, err
+	}
+	return &posts[0], nil
+}
+
+// purgePost permanently removes a deleted post, provided it has not been written since updateTime.
+// It is marked as purging first, so it cannot be restored once the documents about it start being removed.
+// Those are removed before the post itself, so if any cannot be removed the post is still found by
+// PurgeDeletedPosts and they are removed when it is retried. It returns false if the post was restored.
+func (s *Service) purgePost(ctx context.Context, postRef *firestore.DocumentRef, updateTime time.Time) (bool, error) {
+	_, err := postRef.Update(ctx, []firestore.Update{{Path: "purging", Value: true}}, firestore.LastUpdateTime(updateTime))
+	if status.Code(err) == codes.FailedPrecondition || status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := s.deletePostData(ctx, postRef); err != nil {
+		return false, err
+	}
+	_, err = postRef.Delete(ctx)
+	return err == nil, err
+}
+
+// deletePostData removes the subcollections of a deleted post, its like count, and the notifications and reports about it.
+func (s *Service) deletePostData(ctx context.Context, postRef *firestore.DocumentRef) error {
+	bw := s.client.BulkWriter(ctx)
+	job, err := bw.Delete(s.likeCountRef(postRef.ID))
+	if err != nil {
+		bw.End()
+		return err
+	}
+	jobs := []*firestore.BulkWriterJob{job}
+	for _, query := range []firestore.Query{
+		postRef.Collection("likes").Query,
+		postRef.Collection("like_shards").Query,
+		postRef.Collection("revisions").Query,
+		s.client.Collection("notifications").Where("post_id", "==", postRef.ID),
+		s.client.Collection("reports").Where("post_id", "==", postRef.ID),
+	} {
+		docSnaps, err := query.Select().Documents(ctx).GetAll()
+		if err != nil {
+			bw.End()
+			return err
+		}
+		for _, docSnap := range docSnaps {
+			job, err := bw.Delete(docSnap.Ref)
+			if err != nil {
+				bw.End()
+				return err
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	bw.End()
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
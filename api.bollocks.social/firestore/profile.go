@@ -4,13 +4,47 @@ import (
 	"context"
 	"errors"
 
+	"cloud.google.com/go/firestore"
 	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type profile struct {
-	Interests []string `firestore:"interests"`
+	Interests   []string `firestore:"interests"`
+	Handle      string   `firestore:"handle,omitempty"`
+	DisplayName string   `firestore:"display_name,omitempty"`
+	AvatarURL   string   `firestore:"avatar_url,omitempty"`
+}
+
+// handle reserves a handle for a user, keyed by the handle so each can only be taken once.
+type handle struct {
+	UserID string `firestore:"user_id"`
+}
+
+func (p *profile) toAPI() *api.Profile {
+	interests := p.Interests
+	if interests == nil {
+		interests = []string{}
+	}
+	return &api.Profile{
+		Interests:   interests,
+		Handle:      p.Handle,
+		DisplayName: p.DisplayName,
+		AvatarURL:   p.AvatarURL,
+	}
+}
+
+// author returns the public summary of the profile, or nil if the user has not set one up.
+func (p *profile) author() *api.Author {
+	if p.Handle == "" && p.DisplayName == "" {
+		return nil
+	}
+	return &api.Author{
+		Handle:      p.Handle,
+		DisplayName: p.DisplayName,
+		AvatarURL:   p.AvatarURL,
+	}
 }
 
 func (s *Service) GetMyProfile(ctx context.Context) (*api.Profile, error) {
@@ -34,20 +68,103 @@ func (s *Service) GetMyProfile(ctx context.Context) (*api.Profile, error) {
 		return nil, err
 	}
 
-	return &api.Profile{Interests: profile.Interests}, nil
+	return profile.toAPI(), nil
 }
 
-func (s *Service) UpdateMyProfile(ctx context.Context, interests []string) (*api.Profile, error) {
+// UpdateMyProfile applies the fields set in update. Changing handle releases the previous one,
+// and fails with AlreadyExists if the new handle belongs to someone else.
+func (s *Service) UpdateMyProfile(ctx context.Context, update api.ProfileUpdate) (*api.Profile, error) {
 	userID, ok := api.ContextGetUserId(ctx)
 	if !ok {
 		return nil, errors.New("user not found in context")
 	}
 
 	docRef := s.client.Collection("profiles").Doc(userID)
-	_, err := docRef.Set(ctx, profile{Interests: interests})
+	handles := s.client.Collection("handles")
+	var p profile
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		p = profile{}
+		doc, err := tx.Get(docRef)
+		switch {
+		case status.Code(err) == codes.NotFound:
+		case err != nil:
+			return err
+		default:
+			if err := doc.DataTo(&p); err != nil {
+				return err
+			}
+		}
+
+		if update.Handle != nil && *update.Handle != p.Handle {
+			newRef := handles.Doc(*update.Handle)
+			doc, err := tx.Get(newRef)
+			if err == nil {
+				var h handle
+				if err := doc.DataTo(&h); err != nil {
+					return err
+				}
+				if h.UserID != userID {
+					return status.Error(codes.AlreadyExists, "handle taken")
+				}
+			} else if status.Code(err) != codes.NotFound {
+				return err
+			}
+
+			if p.Handle != "" {
+				if err := tx.Delete(handles.Doc(p.Handle)); err != nil {
+					return err
+				}
+			}
+			if err := tx.Set(newRef, handle{UserID: userID}); err != nil {
+				return err
+			}
+			p.Handle = *update.Handle
+		}
+		if update.Interests != nil {
+			p.Interests = update.Interests
+		}
+		if update.DisplayName != nil {
+			p.DisplayName = *update.DisplayName
+		}
+		if update.AvatarURL != nil {
+			p.AvatarURL = *update.AvatarURL
+		}
+		return tx.Set(docRef, p)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.Profile{Interests: interests}, nil
+	return p.toAPI(), nil
+}
+
+// getAuthors returns the public summary of each of the given users that has one.
+func (s *Service) getAuthors(ctx context.Context, userIDs []string) (map[string]*api.Author, error) {
+	authors := make(map[string]*api.Author, len(userIDs))
+	if len(userIDs) == 0 {
+		return authors, nil
+	}
+
+	refs := make([]*firestore.DocumentRef, 0, len(userIDs))
+	for _, id := range userIDs {
+		refs = append(refs, s.client.Collection("profiles").Doc(id))
+	}
+	docSnaps, err := s.client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, docSnap := range docSnaps {
+		if !docSnap.Exists() {
+			continue
+		}
+		var p profile
+		if err := docSnap.DataTo(&p); err != nil {
+			return nil, err
+		}
+		if a := p.author(); a != nil {
+			authors[docSnap.Ref.ID] = a
+		}
+	}
+	return authors, nil
 }
@@ -0,0 +1,218 @@
+package firestore
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// relationship as it is stored in firestore, one document per pair of users under the user it belongs to,
+// keyed by the other user's ID. Documents are removed once none of their fields are set.
+// BlockedBy mirrors the other user's Blocked so the feed can exclude them without reading their relationships.
+type relationship struct {
+	Blocked   bool `firestore:"blocked"`
+	BlockedBy bool `firestore:"blocked_by"`
+	Muted     bool `firestore:"muted"`
+}
+
+// excludes reports whether posts by the other user should be left out of the user's feed.
+func (r relationship) excludes() bool {
+	return r.Blocked || r.BlockedBy || r.Muted
+}
+
+// relationships holds a user's relationships, keyed by the other user's ID.
+type relationships map[string]relationship
+
+// excludes reports whether posts by author should be left out of the user's feed.
+func (r relationships) excludes(author string) bool {
+	return r[author].excludes()
+}
+
+// excludesPost reports whether p should be left out of the user's feed. Anonymous posts are never left out,
+// as leaving them out would reveal who wrote them.
+func (r relationships) excludesPost(p *post) bool {
+	return !p.Anonymous && r.excludes(p.Author)
+}
+
+// relationshipsRef returns the collection of userID's relationships.
+func (s *Service) relationshipsRef(userID string) *firestore.CollectionRef {
+	return s.client.Collection("relationships").Doc(userID).Collection("users")
+}
+
+// relationshipsFromSnapshots decodes the documents of a user's relationships.
+func relationshipsFromSnapshots(docSnaps []*firestore.DocumentSnapshot) (relationships, error) {
+	rel := make(relationships, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		var r relationship
+		if err := docSnap.DataTo(&r); err != nil {
+			return nil, err
+		}
+		rel[docSnap.Ref.ID] = r
+	}
+	return rel, nil
+}
+
+func (s *Service) getRelationships(ctx context.Context, userID string) (relationships, error) {
+	docSnaps, err := s.relationshipsRef(userID).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return relationshipsFromSnapshots(docSnaps)
+}
+
+// getRelationship returns userID's relationship with other, the zero relationship if they have none.
+func (s *Service) getRelationship(ctx context.Context, userID, other string) (relationship, error) {
+	docSnap, err := s.relationshipsRef(userID).Doc(other).Get(ctx)
+	return relationshipFromSnapshot(docSnap, err)
+}
+
+func relationshipFromSnapshot(docSnap *firestore.DocumentSnapshot, err error) (relationship, error) {
+	var r relationship
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return r, nil
+		}
+		return r, err
+	}
+	err = docSnap.DataTo(&r)
+	return r, err
+}
+
+// checkNotBlocked returns the relationship of p's author with userID read within tx, or a PermissionDenied error
+// if the author has blocked userID. Blocks are not applied to anonymous posts, as refusing userID would reveal the author.
+func (s *Service) checkNotBlocked(tx *firestore.Transaction, p *post, userID string) (relationship, error) {
+	r, err := relationshipFromSnapshot(tx.Get(s.relationshipsRef(p.Author).Doc(userID)))
+	if err != nil {
+		return r, err
+	}
+	if r.Blocked && !p.Anonymous {
+		return r, status.Error(codes.PermissionDenied, "blocked by author")
+	}
+	return r, nil
+}
+
+func (s *Service) BlockUser(ctx context.Context, userID string) error {
+	return s.setBlocked(ctx, userID, true)
+}
+
+func (s *Service) UnblockUser(ctx context.Context, userID string) error {
+	return s.setBlocked(ctx, userID, false)
+}
+
+func (s *Service) setBlocked(ctx context.Context, userID string, blocked bool) error {
+	me, _ := api.ContextGetUserId(ctx)
+	if me == userID {
+		return status.Error(codes.InvalidArgument, "cannot block yourself")
+	}
+
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		mine, theirs := s.relationshipsRef(me).Doc(userID), s.relationshipsRef(userID).Doc(me)
+		mineRel, err := relationshipFromSnapshot(tx.Get(mine))
+		if err != nil {
+			return err
+		}
+		theirsRel, err := relationshipFromSnapshot(tx.Get(theirs))
+		if err != nil {
+			return err
+		}
+		mineRel.Blocked, theirsRel.BlockedBy = blocked, blocked
+		if err := setRelationship(tx, mine, mineRel); err != nil {
+			return err
+		}
+		return setRelationship(tx, theirs, theirsRel)
+	})
+}
+
+func (s *Service) MuteUser(ctx context.Context, userID string) error {
+	return s.setMuted(ctx, userID, true)
+}
+
+func (s *Service) UnmuteUser(ctx context.Context, userID string) error {
+	return s.setMuted(ctx, userID, false)
+}
+
+func (s *Service) setMuted(ctx context.Context, userID string, muted bool) error {
+	me, _ := api.ContextGetUserId(ctx)
+	if me == userID {
+		return status.Error(codes.InvalidArgument, "cannot mute yourself")
+	}
+
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref := s.relationshipsRef(me).Doc(userID)
+		r, err := relationshipFromSnapshot(tx.Get(ref))
+		if err != nil {
+			return err
+		}
+		r.Muted = muted
+		return setRelationship(tx, ref, r)
+	})
+}
+
+// setRelationship writes r within tx, removing the document if none of its fields are set.
+func setRelationship(tx *firestore.Transaction, ref *firestore.DocumentRef, r relationship) error {
+	if r == (relationship{}) {
+		return tx.Delete(ref)
+	}
+	return tx.Set(ref, r)
+}
+
+// legacyRelationships as they were stored in firestore, keyed by user ID, before each relationship had its own document.
+type legacyRelationships struct {
+	Blocked   []string `firestore:"blocked"`
+	BlockedBy []string `firestore:"blocked_by"`
+	Muted     []string `firestore:"muted"`
+}
+
+// MigrateRelationships moves every user's legacy blocked, blocked_by and muted arrays into their relationships
+// collection, returning the number of users migrated. It is safe to re-run, as relationships are only added and
+// each user's arrays are removed once all of theirs have been. Blocks and mutes made before the service stored
+// each relationship in its own document do not apply until they are migrated.
+func (s *Service) MigrateRelationships(ctx context.Context) (int, error) {
+	docRefs, err := s.client.Collection("relationships").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, docRef := range docRefs {
+		docSnap, err := docRef.Get(ctx)
+		// Users with only migrated relationships have no document, just the collection under it.
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return migrated, err
+		}
+		var legacy legacyRelationships
+		if err := docSnap.DataTo(&legacy); err != nil {
+			return migrated, err
+		}
+
+		bw := s.client.BulkWriter(ctx)
+		var jobs []*firestore.BulkWriterJob
+		for field, ids := range map[string][]string{"blocked": legacy.Blocked, "blocked_by": legacy.BlockedBy, "muted": legacy.Muted} {
+			for _, id := range ids {
+				job, err := bw.Set(s.relationshipsRef(docRef.ID).Doc(id), map[string]any{field: true}, firestore.MergeAll)
+				if err != nil {
+					bw.End()
+					return migrated, err
+				}
+				jobs = append(jobs, job)
+			}
+		}
+		bw.End()
+		for _, job := range jobs {
+			if _, err := job.Results(); err != nil {
+				return migrated, err
+			}
+		}
+		if _, err := docRef.Delete(ctx, firestore.LastUpdateTime(docSnap.UpdateTime)); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
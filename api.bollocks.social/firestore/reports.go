@@ -0,0 +1,219 @@
+package firestore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// report as it is stored in firestore.
+// A user may only have one open report against a post, but may report it again once it is resolved.
+type report struct {
+	PostID     string     `firestore:"post_id"`
+	Reporter   string     `firestore:"reporter"`
+	Reason     string     `firestore:"reason"`
+	Details    string     `firestore:"details"`
+	Status     string     `firestore:"status"`
+	Action     string     `firestore:"action,omitempty"`
+	CreatedAt  time.Time  `firestore:"created_at"`
+	ResolvedAt *time.Time `firestore:"resolved_at,omitempty"`
+}
+
+func (r *report) toAPI(id string) api.Report {
+	return api.Report{
+		ID:         id,
+		PostID:     r.PostID,
+		Reporter:   r.Reporter,
+		Reason:     r.Reason,
+		Details:    r.Details,
+		Status:     r.Status,
+		Action:     r.Action,
+		CreatedAt:  r.CreatedAt,
+		ResolvedAt: r.ResolvedAt,
+	}
+}
+
+// ReportPost records a report against a post, hiding the post from the feed once it
+// reaches the configured number of reports. Checking for an open report by the caller
+// needs a composite index on reports of post_id, reporter and status.
+func (s *Service) ReportPost(ctx context.Context, postID, reason, details string) (*api.Report, error) {
+	userID, _ := api.ContextGetUserId(ctx)
+	postRef := s.client.Collection("bollocks").Doc(postID)
+	reportRef := s.client.Collection("reports").NewDoc()
+	openReports := s.client.Collection("reports").
+		Where("post_id", "==", postID).
+		Where("reporter", "==", userID).
+		Where("status", "==", api.ReportStatusOpen).
+		Limit(1)
+	r := report{
+		PostID:    postID,
+		Reporter:  userID,
+		Reason:    reason,
+		Details:   details,
+		Status:    api.ReportStatusOpen,
+		CreatedAt: time.Now(),
+	}
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(postRef)
+		if err != nil {
+			return err
+		}
+		p, err := postFromSnapshot(doc)
+		if err != nil {
+			return err
+		}
+		if p.deleted() || p.withheld() {
+			return status.Error(codes.NotFound, "post not found")
+		}
+		if p.Author == userID {
+			return status.Error(codes.InvalidArgument, "cannot report your own post")
+		}
+		docSnaps, err := tx.Documents(openReports).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(docSnaps) > 0 {
+			return status.Error(codes.AlreadyExists, "post already reported")
+		}
+
+		if err := tx.Create(reportRef, r); err != nil {
+			return err
+		}
+		updates := []firestore.Update{{Path: "report_count", Value: firestore.Increment(1)}}
+		if s.cfg.ReportHideThreshold > 0 && p.ReportCount+1 >= s.cfg.ReportHideThreshold {
+			updates = append(updates, firestore.Update{Path: "hidden", Value: true})
+			if err := s.queueHideWebhooks(ctx, tx, postID, &p); err != nil {
+				return err
+			}
+		}
+		return tx.Update(postRef, updates)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := r.toAPI(reportRef.ID)
+	return &report, nil
+}
+
+func (s *Service) ListReports(ctx context.Context, reportStatus string) ([]api.Report, error) {
+	query := s.client.Collection("reports").Where("status", "==", reportStatus).OrderBy("created_at", firestore.Desc).Limit(100)
+	docSnaps, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]api.Report, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		var r report
+		if err := docSnap.DataTo(&r); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r.toAPI(docSnap.Ref.ID))
+	}
+	return reports, nil
+}
+
+// ResolveReport closes a report. Removing hides the reported post from the feed regardless of its report count.
+func (s *Service) ResolveReport(ctx context.Context, reportID, action string) (*api.Report, error) {
+	reportRef := s.client.Collection("reports").Doc(reportID)
+	var r report
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(reportRef)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&r); err != nil {
+			return err
+		}
+
+		// The post may have been purged since it was reported, in which case there is nothing to hide.
+		postRef := s.client.Collection("bollocks").Doc(r.PostID)
+		postSnap, err := tx.Get(postRef)
+		postExists := err == nil
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		now := time.Now()
+		r.Status, r.Action, r.ResolvedAt = api.ReportStatusResolved, action, &now
+		if action == api.ReportActionRemove && postExists {
+			p, err := postFromSnapshot(postSnap)
+			if err != nil {
+				return err
+			}
+			if err := s.queueHideWebhooks(ctx, tx, r.PostID, &p); err != nil {
+				return err
+			}
+			if err := tx.Update(postRef, []firestore.Update{{Path: "hidden", Value: true}}); err != nil {
+				return err
+			}
+		}
+		return tx.Set(reportRef, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := r.toAPI(reportID)
+	return &report, nil
+}
+
+// RestoreReportedPost makes a post hidden by reports visible again and resets its report count.
+// Its open reports are dismissed, so they are not left in the moderation queue.
+func (s *Service) RestoreReportedPost(ctx context.Context, postID string) error {
+	postRef := s.client.Collection("bollocks").Doc(postID)
+	query := s.client.Collection("reports").Where("post_id", "==", postID).Where("status", "==", api.ReportStatusOpen)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		postSnap, err := tx.Get(postRef)
+		if err != nil {
+			return err
+		}
+		p, err := postFromSnapshot(postSnap)
+		if err != nil {
+			return err
+		}
+		docSnaps, err := tx.Documents(query).GetAll()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, docSnap := range docSnaps {
+			if err := tx.Update(docSnap.Ref, []firestore.Update{
+				{Path: "status", Value: api.ReportStatusResolved},
+				{Path: "action", Value: api.ReportActionDismiss},
+				{Path: "resolved_at", Value: now},
+			}); err != nil {
+				return err
+			}
+		}
+		// A post no longer withheld is sent to webhooks as created again.
+		if p.Hidden && !p.deleted() {
+			p.Hidden = false
+			if err := s.queueWebhooksTx(ctx, tx, api.WebhookEventPostCreated, true, postID, &p); err != nil {
+				return err
+			}
+		}
+		return tx.Update(postRef, []firestore.Update{
+			{Path: "hidden", Value: false},
+			{Path: "report_count", Value: 0},
+		})
+	})
+}
+
+// queueHideWebhooks marks p hidden and queues the webhooks for hiding it within tx,
+// which see a post that becomes withheld as deleted.
+func (s *Service) queueHideWebhooks(ctx context.Context, tx *firestore.Transaction, postID string, p *post) error {
+	wasWithheld := p.withheld()
+	p.Hidden = true
+	if p.deleted() {
+		return nil
+	}
+	return s.queueWebhooksTx(ctx, tx, api.WebhookEventPostUpdated, wasWithheld, postID, p)
+}
@@ -0,0 +1,72 @@
+package firestore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// revision as it is stored in the post's "revisions" subcollection, one per edit of its content.
+type revision struct {
+	Bollocks string   `firestore:"bollocks"`
+	Tags     []string `firestore:"tags"`
+	// CreatedAt is when this version of the content was written, ReplacedAt when it was edited.
+	CreatedAt  time.Time `firestore:"created_at"`
+	ReplacedAt time.Time `firestore:"replaced_at"`
+}
+
+// revision returns the current content of the post as a revision replaced at the given time.
+func (p *post) revision(replacedAt time.Time) revision {
+	createdAt := p.EditedAt
+	if createdAt.IsZero() {
+		createdAt = p.CreatedAt
+	}
+	return revision{
+		Bollocks:   p.Bollocks,
+		Tags:       p.Tags,
+		CreatedAt:  createdAt,
+		ReplacedAt: replacedAt,
+	}
+}
+
+// ListRevisions returns the previous versions of a post's content, most recent first.
+// Posts withheld from the feed only show their history to their author.
+func (s *Service) ListRevisions(ctx context.Context, postID string) ([]api.Revision, error) {
+	postRef := s.client.Collection("bollocks").Doc(postID)
+	docSnap, err := postRef.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err := postFromSnapshot(docSnap)
+	if err != nil {
+		return nil, err
+	}
+	userID, _ := api.ContextGetUserId(ctx)
+	if p.deleted() || (p.withheld() && p.Author != userID) {
+		return nil, status.Error(codes.NotFound, "post not found")
+	}
+
+	docSnaps, err := postRef.Collection("revisions").OrderBy("replaced_at", firestore.Desc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]api.Revision, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		var r revision
+		if err := docSnap.DataTo(&r); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, api.Revision{
+			ID:         docSnap.Ref.ID,
+			Bollocks:   r.Bollocks,
+			Tags:       r.Tags,
+			CreatedAt:  r.CreatedAt,
+			ReplacedAt: r.ReplacedAt,
+		})
+	}
+	return revisions, nil
+}
@@ -2,41 +2,60 @@ package firestore
 
 import (
 	"context"
-	"errors"
 	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// post as it is stored in firestore.
-// id is not included as it is part of the document reference.
-type post struct {
-	Bollocks  string    `firestore:"bollocks"`
-	Tags      []string  `firestore:"tags"`
-	Author    string    `firestore:"author"`
-	CreatedAt time.Time `firestore:"created_at"`
-	Likes     []string  `firestore:"likes"`
+type Config struct {
+	// ReportHideThreshold is the number of reports after which a post is hidden from the feed, 0 to never hide.
+	ReportHideThreshold int
+	// LikeShards is the number of shards each post's like counter is split across.
+	// It may be increased but never reduced, as counts held in removed shards would be lost.
+	LikeShards int
+	// EditWindow is how long after creation a post may be edited, 0 to allow edits forever.
+	EditWindow time.Duration
+	// RestoreWindow is how long after deletion a post may be restored, 0 to allow restores until it is purged.
+	RestoreWindow time.Duration
+	// AccountCacheTTL is how long accounts are cached by GetAccount, 0 to read them on every call.
+	// Bans and roles changed through another instance take up to this long to apply.
+	AccountCacheTTL time.Duration
 }
 
 type Service struct {
 	client *firestore.Client
+	cfg    Config
+
+	accountsMu sync.Mutex
+	accounts   map[string]cachedAccount
 }
 
-func NewService(client *firestore.Client) *Service {
+func NewService(client *firestore.Client, cfg Config) *Service {
 	return &Service{
-		client: client,
+		client:   client,
+		cfg:      cfg,
+		accounts: make(map[string]cachedAccount),
 	}
 }
 
 func (s *Service) GetFeed(ctx context.Context) ([]api.Post, error) {
 	userId, _ := api.ContextGetUserId(ctx)
+	rel, err := s.getRelationships(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
 
 	query := s.client.Collection("bollocks").Where("author", "!=", userId).OrderBy("created_at", firestore.Desc)
 	iter := query.Documents(ctx)
-	var posts []api.Post
+	var ids []string
+	var stored []post
 	for {
 		docSnap, err := iter.Next()
 		if err == iterator.Done {
@@ -45,43 +64,63 @@ func (s *Service) GetFeed(ctx context.Context) ([]api.Post, error) {
 		if err != nil {
 			return nil, err
 		}
-		var p post
-		if err := docSnap.DataTo(&p); err != nil {
+		p, err := postFromSnapshot(docSnap)
+		if err != nil {
 			return nil, err
 		}
-
-		posts = append(posts, api.Post{
-			ID:        docSnap.Ref.ID,
-			Bollocks:  p.Bollocks,
-			Tags:      p.Tags,
-			CreatedAt: docSnap.CreateTime,
-			Likes:     len(p.Likes),
-		})
+		if p.deleted() || p.withheld() || rel.excludesPost(&p) {
+			continue
+		}
+		ids = append(ids, docSnap.Ref.ID)
+		stored = append(stored, p)
 	}
-	return posts, nil
+	return s.toAPIPosts(ctx, ids, stored)
 }
 
-func (s *Service) CreatePost(ctx context.Context, bollocks string, tags []string) (*api.Post, error) {
+func (s *Service) CreatePost(ctx context.Context, content api.PostContent) (*api.Post, error) {
 	userId, _ := api.ContextGetUserId(ctx)
-	now := time.Now()
-	docRef, _, err := s.client.Collection("bollocks").Add(ctx, map[string]any{
-		"bollocks":   bollocks,
-		"tags":       tags,
-		"author":     userId,
-		"created_at": now,
-		"likes":      []string{userId},
-	})
+	ents, err := s.resolveEntities(ctx, content.Entities)
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.Post{
-		ID:        docRef.ID,
-		Bollocks:  bollocks,
-		Tags:      tags,
-		CreatedAt: now,
-		Likes:     1,
-	}, nil
+	now := time.Now()
+	p := post{
+		Bollocks:     content.Bollocks,
+		Tags:         content.Tags,
+		Attachments:  toAttachments(content.Attachments),
+		LinkPreviews: toLinkPreviews(content.LinkPreviews),
+		Entities:     ents,
+		TagsStatus:   content.TagsStatus,
+		Author:       userId,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Status:       content.Status,
+		PublishAt:    content.PublishAt,
+		Moderation:   toModeration(content.Moderation),
+		Anonymous:    content.Anonymous,
+	}
+	if p.published() {
+		p.PublishedAt = now
+	}
+	// Authors like their own posts.
+	docRef := s.client.Collection("bollocks").NewDoc()
+	batch := s.client.Batch()
+	batch.Create(docRef, p)
+	batch.Create(docRef.Collection("likes").Doc(userId), like{CreatedAt: now})
+	batch.Set(s.likeShard(docRef), likeShard{Count: 1, Counted: true})
+	batch.Create(s.likeCountRef(docRef.ID), likeCount{Count: 1})
+	if err := s.queueWebhooks(ctx, batch, api.WebhookEventPostCreated, true, docRef.ID, &p); err != nil {
+		return nil, err
+	}
+	if err := s.notifyMentions(ctx, batch, docRef.ID, &p, nil); err != nil {
+		return nil, err
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.toAPIPost(ctx, docRef.ID, p)
 }
 
 func (s *Service) GetPosts(ctx context.Context) ([]api.Post, error) {
@@ -89,7 +128,8 @@ func (s *Service) GetPosts(ctx context.Context) ([]api.Post, error) {
 
 	query := s.client.Collection("bollocks").Where("author", "==", userId).OrderBy("created_at", firestore.Desc)
 	iter := query.Documents(ctx)
-	var posts []api.Post
+	var ids []string
+	var stored []post
 	for {
 		docSnap, err := iter.Next()
 		if err == iterator.Done {
@@ -98,112 +138,305 @@ func (s *Service) GetPosts(ctx context.Context) ([]api.Post, error) {
 		if err != nil {
 			return nil, err
 		}
-		var p post
-		if err := docSnap.DataTo(&p); err != nil {
+		p, err := postFromSnapshot(docSnap)
+		if err != nil {
 			return nil, err
 		}
+		// Unpublished posts are listed by ListDrafts.
+		if p.deleted() || !p.published() {
+			continue
+		}
+		ids = append(ids, docSnap.Ref.ID)
+		stored = append(stored, p)
+	}
+	return s.toAPIPosts(ctx, ids, stored)
+}
 
-		posts = append(posts, api.Post{
-			ID:        docSnap.Ref.ID,
-			Bollocks:  p.Bollocks,
-			Tags:      p.Tags,
-			CreatedAt: p.CreatedAt,
-			Likes:     len(p.Likes),
-		})
+// GetPost returns a single post, posts withheld from the feed are only returned to their author.
+func (s *Service) GetPost(ctx context.Context, postID string) (*api.Post, error) {
+	docSnap, err := s.client.Collection("bollocks").Doc(postID).Get(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return posts, nil
+	p, err := postFromSnapshot(docSnap)
+	if err != nil {
+		return nil, err
+	}
+	userID, _ := api.ContextGetUserId(ctx)
+	if p.deleted() || (p.withheld() && p.Author != userID) {
+		return nil, status.Error(codes.NotFound, "post not found")
+	}
+	return s.toAPIPost(ctx, docSnap.Ref.ID, p)
 }
 
+// DeletePost marks a post as deleted, it can be restored by its author until the restore window
+// has passed and is permanently removed by PurgeDeletedPosts. Deleting a scheduled post unschedules it.
 func (s *Service) DeletePost(ctx context.Context, postID string) error {
 	docRef := s.client.Collection("bollocks").Doc(postID)
 	docSnap, err := docRef.Get(ctx)
 	if err != nil {
 		return err
 	}
-
-	author, err := docSnap.DataAt("author")
+	p, err := postFromSnapshot(docSnap)
 	if err != nil {
 		return err
 	}
+	if p.deleted() {
+		return status.Error(codes.NotFound, "post not found")
+	}
+	userID, _ := api.ContextGetUserId(ctx)
+	if p.Author != userID {
+		return status.Error(codes.PermissionDenied, "not the author")
+	}
+
+	updates := []firestore.Update{{Path: "deleted_at", Value: time.Now()}, p.versionUpdate()}
+	if !p.PublishAt.IsZero() {
+		// A deleted post is no longer due, if it is restored it is restored as a draft.
+		updates = append(updates,
+			firestore.Update{Path: "publish_at", Value: firestore.Delete},
+			firestore.Update{Path: "status", Value: api.PostStatusDraft},
+		)
+	}
+	batch := s.client.Batch()
+	batch.Update(docRef, updates, firestore.LastUpdateTime(docSnap.UpdateTime))
+	if err := s.queueWebhooks(ctx, batch, api.WebhookEventPostDeleted, p.withheld(), docRef.ID, &p); err != nil {
+		return err
+	}
+	_, err = batch.Commit(ctx)
+	return err
+}
 
+// RestorePost undoes the deletion of a post, provided the restore window has not passed.
+func (s *Service) RestorePost(ctx context.Context, postID string) (*api.Post, error) {
+	docRef := s.client.Collection("bollocks").Doc(postID)
+	docSnap, err := docRef.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err := postFromSnapshot(docSnap)
+	if err != nil {
+		return nil, err
+	}
 	userID, _ := api.ContextGetUserId(ctx)
+	if p.Author != userID {
+		return nil, status.Error(codes.PermissionDenied, "not the author")
+	}
+	if !p.deleted() {
+		return nil, status.Error(codes.FailedPrecondition, "post is not deleted")
+	}
+	if p.Purging {
+		return nil, status.Error(codes.NotFound, "post not found")
+	}
+	// Posts past the restore window are treated as gone even if they have not been purged yet.
+	if s.cfg.RestoreWindow > 0 && time.Since(p.DeletedAt) > s.cfg.RestoreWindow {
+		return nil, status.Error(codes.NotFound, "post not found")
+	}
 
-	if author != userID {
-		return errors.New("forbidden")
+	p.DeletedAt = time.Time{}
+	batch := s.client.Batch()
+	batch.Update(docRef, []firestore.Update{{Path: "deleted_at", Value: firestore.Delete}, p.versionUpdate()}, firestore.LastUpdateTime(docSnap.UpdateTime))
+	// Webhooks were sent the post as deleted, so it is sent to them as created again.
+	if err := s.queueWebhooks(ctx, batch, api.WebhookEventPostCreated, true, docRef.ID, &p); err != nil {
+		return nil, err
 	}
+	if _, err := batch.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return s.toAPIPost(ctx, docRef.ID, p)
+}
 
-	_, err = docRef.Delete(ctx, firestore.Exists)
-	return err
+// PurgeDeletedPosts permanently removes up to limit posts deleted before the given time,
+// returning the number removed.
+func (s *Service) PurgeDeletedPosts(ctx context.Context, before time.Time, limit int) (int, error) {
+	query := s.client.Collection("bollocks").Where("deleted_at", "<=", before).Limit(limit)
+	docSnaps, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, docSnap := range docSnaps {
+		// Posts restored since the query are skipped.
+		ok, err := s.purgePost(ctx, docSnap.Ref, docSnap.UpdateTime)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged++
+		}
+	}
+	return purged, nil
 }
 
-func (s *Service) UpdatePost(ctx context.Context, postID, bollocks string, tags []string) (*api.Post, error) {
+// UpdatePost replaces the content of a post. If version is set the update fails with FailedPrecondition
+// unless it matches the stored post, otherwise a concurrent write fails it with Aborted.
+func (s *Service) UpdatePost(ctx context.Context, postID, version string, content api.PostContent) (*api.Post, error) {
 	docRef := s.client.Collection("bollocks").Doc(postID)
 	docSnap, err := docRef.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	var p post
-	if err := docSnap.DataTo(&p); err != nil {
+	p, err := postFromSnapshot(docSnap)
+	if err != nil {
 		return nil, err
 	}
+	if p.deleted() {
+		return nil, status.Error(codes.NotFound, "post not found")
+	}
 	userID, _ := api.ContextGetUserId(ctx)
 	if userID != p.Author {
-		return nil, errors.New("forbidden")
+		return nil, status.Error(codes.PermissionDenied, "not the author")
+	}
+	if version != "" && version != strconv.FormatInt(p.Version, 10) {
+		return nil, status.Error(codes.FailedPrecondition, "post has been modified")
 	}
 
-	_, err = docRef.Update(ctx, []firestore.Update{
-		{Path: "bollocks", Value: bollocks},
-		{Path: "tags", Value: tags},
-	}, firestore.LastUpdateTime(docSnap.UpdateTime))
-	if err != nil {
+	now := time.Now()
+	if s.cfg.EditWindow > 0 && p.published() && now.Sub(p.CreatedAt) > s.cfg.EditWindow {
+		return nil, status.Error(codes.PermissionDenied, "edit window has closed")
+	}
+
+	// Moderating the new content may withhold the post or release it, which webhooks see as it being deleted or created.
+	wasWithheld := p.withheld()
+	// The precondition fails the whole batch if the post changed since it was read,
+	// so a revision is never recorded for an edit that was not applied.
+	batch := s.client.Batch()
+	// Only a change of content marks the post as edited and records a revision,
+	// resubmitting it unchanged just regenerates its tags.
+	if p.Bollocks != content.Bollocks {
+		batch.Create(docRef.Collection("revisions").NewDoc(), p.revision(now))
+		p.Edited, p.EditedAt = true, now
+	}
+	p.Bollocks, p.Tags, p.TagsStatus = content.Bollocks, content.Tags, content.TagsStatus
+	p.LinkPreviews = toLinkPreviews(content.LinkPreviews)
+	previousEntities := p.Entities
+	if p.Entities, err = s.resolveEntities(ctx, content.Entities); err != nil {
 		return nil, err
 	}
+	p.UpdatedAt = now
+	updates := []firestore.Update{
+		{Path: "bollocks", Value: p.Bollocks},
+		{Path: "tags", Value: p.Tags},
+		{Path: "tags_status", Value: p.TagsStatus},
+		{Path: "link_previews", Value: p.LinkPreviews},
+		{Path: "entities", Value: p.Entities},
+		{Path: "updated_at", Value: p.UpdatedAt},
+		{Path: "edited", Value: p.Edited},
+		p.versionUpdate(),
+	}
+	if p.Edited {
+		updates = append(updates, firestore.Update{Path: "edited_at", Value: p.EditedAt})
+	}
+	if content.Attachments != nil {
+		p.Attachments = toAttachments(content.Attachments)
+		updates = append(updates, firestore.Update{Path: "attachments", Value: p.Attachments})
+	}
+	if content.Moderation != nil {
+		p.Moderation = toModeration(content.Moderation)
+		updates = append(updates, firestore.Update{Path: "moderation", Value: p.Moderation})
+	}
+	if err := s.notifyMentions(ctx, batch, docRef.ID, &p, previousEntities); err != nil {
+		return nil, err
+	}
+	if err := s.queueWebhooks(ctx, batch, api.WebhookEventPostUpdated, wasWithheld, docRef.ID, &p); err != nil {
+		return nil, err
+	}
+	// The precondition is on the document rather than its version, as background writes such as
+	// its tags must not be overwritten either. Those do not change the version, so it is left to
+	// the caller to retry rather than failing as modified.
+	batch.Update(docRef, updates, firestore.LastUpdateTime(docSnap.UpdateTime))
+	if _, err := batch.Commit(ctx); err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, status.Error(codes.Aborted, "post was modified concurrently")
+		}
+		return nil, err
+	}
+
+	return s.toAPIPost(ctx, docRef.ID, p)
+}
+
+// decorate sets the fields of posts held in other documents, where stored holds the post at the same index.
+func (s *Service) decorate(ctx context.Context, posts []api.Post, stored []post) error {
+	if err := s.setAuthors(ctx, posts, stored); err != nil {
+		return err
+	}
+	return s.setLikes(ctx, posts, stored)
+}
 
-	return &api.Post{
-		ID:        docRef.ID,
-		Bollocks:  bollocks,
-		Tags:      tags,
-		CreatedAt: p.CreatedAt,
-		Likes:     len(p.Likes),
-	}, nil
+// setAuthors sets the public author summary on each post, where stored holds the post at the same index.
+func (s *Service) setAuthors(ctx context.Context, posts []api.Post, stored []post) error {
+	var ids []string
+	for _, p := range stored {
+		if id := p.publicAuthor(); id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	authors, err := s.getAuthors(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i, p := range stored {
+		if id := p.publicAuthor(); id != "" {
+			posts[i].Author = authors[id]
+		}
+	}
+	return nil
 }
 
-func (s *Service) ToggleLike(ctx context.Context, postID string) (*api.Post, error) {
+// SetPostTags stores tags generated in the background and marks them complete.
+// The tags are discarded if the post has since been purged or its content edited, as the edit
+// will have queued its own job, and left pending while it is deleted, so it is tagged if restored.
+// The post's version is unchanged, so an edit against the version it was created with still applies.
+func (s *Service) SetPostTags(ctx context.Context, postID, content string, tags []string) error {
 	docRef := s.client.Collection("bollocks").Doc(postID)
-	var p post
-	var isCurrentlyLiked bool
-	var likesCount int
-	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
 		doc, err := tx.Get(docRef)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		if err := doc.DataTo(&p); err != nil {
+		p, err := postFromSnapshot(doc)
+		if err != nil {
 			return err
 		}
-		likesCount = len(p.Likes)
-		userId, _ := api.ContextGetUserId(ctx)
-		isCurrentlyLiked = slices.Contains(p.Likes, userId)
-		var update firestore.Update
-		if isCurrentlyLiked {
-			likesCount--
-			update = firestore.Update{Path: "likes", Value: firestore.ArrayRemove(userId)}
-		} else {
-			likesCount++
-			update = firestore.Update{Path: "likes", Value: firestore.ArrayUnion(userId)}
-		}
-		return tx.Update(docRef, []firestore.Update{update})
+		if p.deleted() || p.Bollocks != content {
+			return nil
+		}
+		return tx.Update(docRef, []firestore.Update{
+			{Path: "tags", Value: tags},
+			{Path: "tags_status", Value: api.TagsStatusComplete},
+			{Path: "updated_at", Value: time.Now()},
+		})
 	})
-	if err != nil {
-		return nil, err
-	}
+}
 
-	return &api.Post{
-		ID:        docRef.ID,
-		Bollocks:  p.Bollocks,
-		Tags:      p.Tags,
-		CreatedAt: p.CreatedAt,
-		Likes:     likesCount,
-	}, nil
+// PendingTagPosts returns up to limit posts whose tags are still being generated.
+// Deleted posts are skipped until they are restored or purged.
+func (s *Service) PendingTagPosts(ctx context.Context, limit int) ([]api.Post, error) {
+	iter := s.client.Collection("bollocks").Where("tags_status", "==", api.TagsStatusPending).Documents(ctx)
+	defer iter.Stop()
+
+	// Only the content is needed to tag a post, so the posts are not decorated.
+	var posts []api.Post
+	for len(posts) < limit {
+		docSnap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, err := postFromSnapshot(docSnap)
+		if err != nil {
+			return nil, err
+		}
+		if p.deleted() {
+			continue
+		}
+		posts = append(posts, p.toAPI(docSnap.Ref.ID, ""))
+	}
+	return posts, nil
 }
@@ -0,0 +1,236 @@
+package firestore
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxWatchedPosts is the number of posts sent on a feed stream whose like counts are watched,
+// older posts stop being watched as new ones are sent.
+const maxWatchedPosts = 100
+
+// WatchFeed sends changes to the caller's feed to events until ctx is done: posts published
+// from now on and changes to the like counts of the posts it has sent, both received through sub,
+// which is shared with every other stream on the instance. Only the caller's blocks and mutes are
+// watched for each stream, and posts are filtered by them as they change, like GetFeed.
+func (s *Service) WatchFeed(ctx context.Context, sub api.Subscription, events chan<- api.FeedEvent) error {
+	userID, _ := api.ContextGetUserId(ctx)
+	rel, err := s.getRelationships(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	// The listener is stopped before waiting for it to return.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rels := make(chan relationships)
+	errs := make(chan error, 1)
+	wg.Go(func() {
+		iter := s.relationshipsRef(userID).Snapshots(ctx)
+		defer iter.Stop()
+		for {
+			snap, err := iter.Next()
+			if err != nil {
+				errs <- err
+				return
+			}
+			docSnaps, err := snap.Documents.GetAll()
+			if err != nil {
+				errs <- err
+				return
+			}
+			r, err := relationshipsFromSnapshots(docSnaps)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case rels <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	// watched holds the author of each post sent whose like count is watched, in the order they were sent,
+	// empty for anonymous posts.
+	watched := make(map[string]string)
+	var watchOrder []string
+	unwatch := func(postID string) {
+		if _, ok := watched[postID]; ok {
+			sub.UnsubscribePost(postID)
+			delete(watched, postID)
+			watchOrder = slices.DeleteFunc(watchOrder, func(id string) bool { return id == postID })
+		}
+	}
+	send := func(event api.FeedEvent) error {
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	sub.SetFeed(true)
+	for {
+		select {
+		case rel = <-rels:
+		case event, ok := <-sub.Events():
+			if !ok {
+				return status.Error(codes.Unavailable, "feed stream fell behind")
+			}
+			switch event.Type {
+			case api.EventPost:
+				if event.Post.Removed {
+					unwatch(event.Post.Post.ID)
+					continue
+				}
+				post := event.Post.Post
+				// Anonymous posts are not filtered by who wrote them, like GetFeed.
+				author := event.Post.Author
+				if author == userID {
+					continue
+				}
+				if post.Anonymous {
+					author = ""
+				}
+				if rel.excludes(author) {
+					continue
+				}
+				watched[post.ID] = author
+				watchOrder = append(watchOrder, post.ID)
+				sub.SubscribePost(post.ID)
+				if len(watchOrder) > maxWatchedPosts {
+					unwatch(watchOrder[0])
+				}
+				if err := send(api.FeedEvent{Type: api.FeedEventPost, Post: &post}); err != nil {
+					return err
+				}
+			case api.EventLikes:
+				// The post may have stopped being watched since the count was published.
+				author, ok := watched[event.Likes.PostID]
+				if !ok || rel.excludes(author) {
+					continue
+				}
+				if err := send(api.FeedEvent{Type: api.FeedEventLikes, Likes: event.Likes}); err != nil {
+					return err
+				}
+			}
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WatchPosts calls publish with each post published from now on, as users other than its author see it,
+// and with each of them removed from the feed once deleted or withheld, until ctx is done.
+// Scheduled posts are dated when they were due, so new posts are found by when they were published.
+// Each post is published once when it is added, as posts change again as tags are generated.
+func (s *Service) WatchPosts(ctx context.Context, publish func(api.FeedPost)) error {
+	iter := s.client.Collection("bollocks").Where("published_at", ">", time.Now()).Snapshots(ctx)
+	defer iter.Stop()
+	for {
+		querySnap, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		var ids []string
+		var stored []post
+		for _, change := range querySnap.Changes {
+			p, err := postFromSnapshot(change.Doc)
+			if err != nil {
+				return err
+			}
+			switch {
+			case change.Kind == firestore.DocumentAdded && !p.deleted() && !p.withheld():
+				ids = append(ids, change.Doc.Ref.ID)
+				stored = append(stored, p)
+			case change.Kind == firestore.DocumentRemoved || p.deleted() || p.withheld():
+				publish(api.FeedPost{Post: api.Post{ID: change.Doc.Ref.ID}, Author: p.Author, Removed: true})
+			}
+		}
+		// Posts are mapped without a caller, so as users other than their author see them.
+		posts, err := s.toAPIPosts(ctx, ids, stored)
+		if err != nil {
+			return err
+		}
+		for i, post := range posts {
+			publish(api.FeedPost{Post: post, Author: stored[i].Author})
+		}
+	}
+}
+
+// WatchLikes calls publish with the like count of a post each time it changes, until ctx is done.
+// Counts are watched from like_counts, so they trail likes by up to the counting interval.
+func (s *Service) WatchLikes(ctx context.Context, postID string, publish func(api.LikeCount)) error {
+	iter := s.likeCountRef(postID).Snapshots(ctx)
+	defer iter.Stop()
+	// Subscribers are sent the current count when they subscribe, only changes to it are published.
+	count, first := 0, true
+	for {
+		docSnap, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		var c likeCount
+		if docSnap.Exists() {
+			if err := docSnap.DataTo(&c); err != nil {
+				return err
+			}
+		}
+		if !first && c.Count != count {
+			publish(api.LikeCount{PostID: postID, Likes: c.Count})
+		}
+		count, first = c.Count, false
+	}
+}
+
+// WatchNotifications calls publish with each of a user's notifications created or updated from now on, until ctx is done.
+// Notifications are watched by a query on recipient and updated_at, which needs a composite index on those fields.
+func (s *Service) WatchNotifications(ctx context.Context, userID string, publish func(api.Notification)) error {
+	query := s.client.Collection("notifications").Where("recipient", "==", userID).Where("updated_at", ">", time.Now())
+	iter := query.Snapshots(ctx)
+	defer iter.Stop()
+	for {
+		querySnap, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		var ids []string
+		var stored []notification
+		for _, change := range querySnap.Changes {
+			if change.Kind == firestore.DocumentRemoved {
+				continue
+			}
+			var n notification
+			if err := change.Doc.DataTo(&n); err != nil {
+				return err
+			}
+			// Marking a notification read is not published.
+			if n.Read {
+				continue
+			}
+			ids = append(ids, change.Doc.Ref.ID)
+			stored = append(stored, n)
+		}
+		notifications, err := s.toAPINotifications(ctx, ids, stored)
+		if err != nil {
+			return err
+		}
+		for _, n := range notifications {
+			publish(n)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package firestore
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cachedTags as stored in firestore, keyed by a hash of the content and the configuration it was tagged with.
+type cachedTags struct {
+	Tags      []string  `firestore:"tags"`
+	CreatedAt time.Time `firestore:"created_at"`
+}
+
+// GetCachedTags returns the tags cached under key, ok is false unless they were cached at or after since.
+func (s *Service) GetCachedTags(ctx context.Context, key string, since time.Time) ([]string, bool, error) {
+	docSnap, err := s.client.Collection("tag_cache").Doc(key).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	var c cachedTags
+	if err := docSnap.DataTo(&c); err != nil {
+		return nil, false, err
+	}
+	if c.CreatedAt.Before(since) {
+		return nil, false, nil
+	}
+	return c.Tags, true, nil
+}
+
+func (s *Service) SetCachedTags(ctx context.Context, key string, tags []string) error {
+	_, err := s.client.Collection("tag_cache").Doc(key).Set(ctx, cachedTags{Tags: tags, CreatedAt: time.Now()})
+	return err
+}
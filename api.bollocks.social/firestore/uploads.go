@@ -0,0 +1,76 @@
+package firestore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/media"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// upload as stored in firestore, keyed by upload ID.
+type upload struct {
+	User        string    `firestore:"user"`
+	ContentType string    `firestore:"content_type"`
+	ExpiresAt   time.Time `firestore:"expires_at"`
+	Attached    bool      `firestore:"attached"`
+	CreatedAt   time.Time `firestore:"created_at"`
+}
+
+func (s *Service) CreateUpload(ctx context.Context, userID, uploadID string, u media.Upload) error {
+	_, err := s.client.Collection("uploads").Doc(uploadID).Create(ctx, upload{
+		User:        userID,
+		ContentType: u.ContentType,
+		ExpiresAt:   u.ExpiresAt,
+		Attached:    u.Attached,
+		CreatedAt:   time.Now(),
+	})
+	return err
+}
+
+func (s *Service) GetUpload(ctx context.Context, userID, uploadID string) (*media.Upload, bool, error) {
+	docSnap, err := s.client.Collection("uploads").Doc(uploadID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	var u upload
+	if err := docSnap.DataTo(&u); err != nil {
+		return nil, false, err
+	}
+	// Other users' uploads are not revealed.
+	if u.User != userID {
+		return nil, false, nil
+	}
+	return &media.Upload{ContentType: u.ContentType, ExpiresAt: u.ExpiresAt, Attached: u.Attached}, true, nil
+}
+
+func (s *Service) SetUploadAttached(ctx context.Context, userID, uploadID string, attached bool) (bool, error) {
+	ref := s.client.Collection("uploads").Doc(uploadID)
+	var changed bool
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		changed = false
+		docSnap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var u upload
+		if err := docSnap.DataTo(&u); err != nil {
+			return err
+		}
+		if u.User != userID {
+			return status.Errorf(codes.NotFound, "upload %s not found", uploadID)
+		}
+		if u.Attached == attached {
+			return nil
+		}
+		changed = true
+		return tx.Update(ref, []firestore.Update{{Path: "attached", Value: attached}})
+	})
+	return changed, err
+}
@@ -0,0 +1,468 @@
+package firestore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Deliveries are stored in the "webhook_deliveries" collection, created in the same write as the change
+// they describe so no event is lost, and the attempts to deliver each in its "attempts" subcollection.
+
+// maxWebhooks is the number of webhooks a user may register, global webhooks are not limited.
+const maxWebhooks = 10
+
+// webhook as it is stored in firestore. Owner is the user who registered it, for global webhooks the admin.
+type webhook struct {
+	Owner     string    `firestore:"owner"`
+	Global    bool      `firestore:"global"`
+	URL       string    `firestore:"url"`
+	Events    []string  `firestore:"events"`
+	Secret    string    `firestore:"secret"`
+	CreatedAt time.Time `firestore:"created_at"`
+}
+
+func (w *webhook) toAPI(id string) api.Webhook {
+	return api.Webhook{
+		ID:        id,
+		URL:       w.URL,
+		Events:    w.Events,
+		Global:    w.Global,
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+// webhookDelivery as it is stored in firestore. NextAttemptAt is removed once the delivery is no longer pending.
+type webhookDelivery struct {
+	WebhookID     string    `firestore:"webhook_id"`
+	Event         string    `firestore:"event"`
+	Payload       string    `firestore:"payload"`
+	Status        string    `firestore:"status"`
+	Attempts      int       `firestore:"attempts"`
+	NextAttemptAt time.Time `firestore:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time `firestore:"created_at"`
+	UpdatedAt     time.Time `firestore:"updated_at"`
+}
+
+func (d *webhookDelivery) toAPI(id string) api.WebhookDelivery {
+	delivery := api.WebhookDelivery{
+		ID:        id,
+		WebhookID: d.WebhookID,
+		Event:     d.Event,
+		Payload:   json.RawMessage(d.Payload),
+		Status:    d.Status,
+		Attempts:  d.Attempts,
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.UpdatedAt,
+	}
+	if !d.NextAttemptAt.IsZero() {
+		delivery.NextAttemptAt = &d.NextAttemptAt
+	}
+	return delivery
+}
+
+// webhookAttempt as it is stored in firestore, keyed by attempt number.
+type webhookAttempt struct {
+	Attempt    int       `firestore:"attempt"`
+	At         time.Time `firestore:"at"`
+	StatusCode int       `firestore:"status_code"`
+	Error      string    `firestore:"error"`
+	DurationMS int64     `firestore:"duration_ms"`
+}
+
+// CreateWebhook registers a webhook for the caller's posts, or for every post if global.
+// The secret deliveries are signed with is generated here and only returned now.
+func (s *Service) CreateWebhook(ctx context.Context, in api.WebhookInput, global bool) (*api.Webhook, error) {
+	userID, _ := api.ContextGetUserId(ctx)
+	col := s.client.Collection("webhooks")
+	if !global {
+		query := col.Where("owner", "==", userID).Where("global", "==", false)
+		result, err := query.NewAggregationQuery().WithCount("webhooks").Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		count, ok := result["webhooks"].(*firestorepb.Value)
+		if !ok {
+			return nil, errors.New("webhook count missing from aggregation result")
+		}
+		if count.GetIntegerValue() >= maxWebhooks {
+			return nil, status.Error(codes.ResourceExhausted, "too many webhooks")
+		}
+	}
+
+	w := webhook{
+		Owner:     userID,
+		Global:    global,
+		URL:       in.URL,
+		Events:    in.Events,
+		Secret:    "whsec_" + rand.Text(),
+		CreatedAt: time.Now(),
+	}
+	docRef := col.NewDoc()
+	if _, err := docRef.Create(ctx, w); err != nil {
+		return nil, err
+	}
+
+	created := w.toAPI(docRef.ID)
+	created.Secret = w.Secret
+	return &created, nil
+}
+
+// ListWebhooks returns the caller's webhooks, or the global webhooks.
+func (s *Service) ListWebhooks(ctx context.Context, global bool) ([]api.Webhook, error) {
+	userID, _ := api.ContextGetUserId(ctx)
+	query := s.client.Collection("webhooks").Where("global", "==", true)
+	if !global {
+		query = s.client.Collection("webhooks").Where("owner", "==", userID).Where("global", "==", false)
+	}
+	docSnaps, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]api.Webhook, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		var w webhook
+		if err := docSnap.DataTo(&w); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w.toAPI(docSnap.Ref.ID))
+	}
+	slices.SortFunc(webhooks, func(a, b api.Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return webhooks, nil
+}
+
+// getWebhook returns a webhook the caller may manage: their own, or a global webhook if they are an admin.
+// Other webhooks are not found.
+func (s *Service) getWebhook(ctx context.Context, webhookID string) (*webhook, error) {
+	docSnap, err := s.client.Collection("webhooks").Doc(webhookID).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var w webhook
+	if err := docSnap.DataTo(&w); err != nil {
+		return nil, err
+	}
+	userID, _ := api.ContextGetUserId(ctx)
+	if w.Global && !api.ContextHasRole(ctx, api.RoleAdmin) || !w.Global && w.Owner != userID {
+		return nil, status.Error(codes.NotFound, "webhook not found")
+	}
+	return &w, nil
+}
+
+// DeleteWebhook removes a webhook, its pending deliveries fail when they are next due and are purged
+// with its other deliveries once past their retention.
+func (s *Service) DeleteWebhook(ctx context.Context, webhookID string) error {
+	if _, err := s.getWebhook(ctx, webhookID); err != nil {
+		return err
+	}
+	_, err := s.client.Collection("webhooks").Doc(webhookID).Delete(ctx)
+	return err
+}
+
+// ListWebhookDeliveries returns the most recent deliveries to a webhook, optionally only those with the given status.
+func (s *Service) ListWebhookDeliveries(ctx context.Context, webhookID, deliveryStatus string) ([]api.WebhookDelivery, error) {
+	if _, err := s.getWebhook(ctx, webhookID); err != nil {
+		return nil, err
+	}
+	query := s.client.Collection("webhook_deliveries").Where("webhook_id", "==", webhookID)
+	if deliveryStatus != "" {
+		query = query.Where("status", "==", deliveryStatus)
+	}
+	docSnaps, err := query.OrderBy("created_at", firestore.Desc).Limit(100).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]api.WebhookDelivery, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		var d webhookDelivery
+		if err := docSnap.DataTo(&d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d.toAPI(docSnap.Ref.ID))
+	}
+	return deliveries, nil
+}
+
+// GetWebhookDelivery returns a delivery to a webhook along with the log of attempts to deliver it.
+func (s *Service) GetWebhookDelivery(ctx context.Context, webhookID, deliveryID string) (*api.WebhookDelivery, error) {
+	if _, err := s.getWebhook(ctx, webhookID); err != nil {
+		return nil, err
+	}
+	docRef := s.client.Collection("webhook_deliveries").Doc(deliveryID)
+	docSnap, err := docRef.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var d webhookDelivery
+	if err := docSnap.DataTo(&d); err != nil {
+		return nil, err
+	}
+	if d.WebhookID != webhookID {
+		return nil, status.Error(codes.NotFound, "delivery not found")
+	}
+
+	attemptSnaps, err := docRef.Collection("attempts").OrderBy("attempt", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	delivery := d.toAPI(docRef.ID)
+	delivery.Log = make([]api.WebhookAttempt, 0, len(attemptSnaps))
+	for _, attemptSnap := range attemptSnaps {
+		var a webhookAttempt
+		if err := attemptSnap.DataTo(&a); err != nil {
+			return nil, err
+		}
+		delivery.Log = append(delivery.Log, api.WebhookAttempt(a))
+	}
+	return &delivery, nil
+}
+
+// queueWebhooks adds the deliveries of an event about a post to batch.
+func (s *Service) queueWebhooks(ctx context.Context, batch *firestore.WriteBatch, event string, wasWithheld bool, postID string, p *post) error {
+	deliveries, err := s.webhookDeliveries(ctx, event, wasWithheld, postID, p)
+	if err != nil {
+		return err
+	}
+	for ref, d := range deliveries {
+		batch.Create(ref, d)
+	}
+	return nil
+}
+
+// queueWebhooksTx adds the deliveries of an event about a post to tx.
+func (s *Service) queueWebhooksTx(ctx context.Context, tx *firestore.Transaction, event string, wasWithheld bool, postID string, p *post) error {
+	deliveries, err := s.webhookDeliveries(ctx, event, wasWithheld, postID, p)
+	if err != nil {
+		return err
+	}
+	for ref, d := range deliveries {
+		if err := tx.Create(ref, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookEvent returns the event sent to webhooks about a change to a post, given whether the post was withheld
+// from other users before it, or empty if none is. Webhooks only see posts while they are not withheld:
+// a post that becomes withheld is sent as deleted, and one that stops being withheld as created.
+func webhookEvent(event string, wasWithheld bool, p *post) string {
+	withheld := p.withheld() || event == api.WebhookEventPostDeleted
+	switch {
+	case wasWithheld && withheld:
+		return ""
+	case wasWithheld:
+		return api.WebhookEventPostCreated
+	case withheld:
+		return api.WebhookEventPostDeleted
+	}
+	return event
+}
+
+// webhookDeliveries returns a delivery of the webhookEvent for a change to a post to each webhook subscribed
+// to it, keyed by the document to create it as. They are created in the same write as the change to the post.
+func (s *Service) webhookDeliveries(ctx context.Context, event string, wasWithheld bool, postID string, p *post) (map[*firestore.DocumentRef]webhookDelivery, error) {
+	if event = webhookEvent(event, wasWithheld, p); event == "" {
+		return nil, nil
+	}
+	query := s.client.Collection("webhooks").WhereEntity(firestore.OrFilter{Filters: []firestore.EntityFilter{
+		firestore.PropertyFilter{Path: "owner", Operator: "==", Value: p.Author},
+		firestore.PropertyFilter{Path: "global", Operator: "==", Value: true},
+	}})
+	docSnaps, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var payload []byte
+	deliveries := make(map[*firestore.DocumentRef]webhookDelivery)
+	for _, docSnap := range docSnaps {
+		var w webhook
+		if err := docSnap.DataTo(&w); err != nil {
+			return nil, err
+		}
+		// An admin's own webhooks are only for their own posts.
+		if !w.Global && w.Owner != p.Author || !slices.Contains(w.Events, event) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(api.WebhookPayload{ID: rand.Text(), Type: event, CreatedAt: now, Post: p.toWebhook(postID, event)}); err != nil {
+				return nil, err
+			}
+		}
+		deliveries[s.client.Collection("webhook_deliveries").NewDoc()] = webhookDelivery{
+			WebhookID:     docSnap.Ref.ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        api.DeliveryStatusPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+	}
+	return deliveries, nil
+}
+
+func (p *post) toWebhook(id, event string) *api.WebhookPost {
+	if event == api.WebhookEventPostDeleted {
+		return &api.WebhookPost{ID: id}
+	}
+	wp := &api.WebhookPost{
+		ID:        id,
+		Bollocks:  p.Bollocks,
+		Tags:      p.Tags,
+		Anonymous: p.Anonymous,
+		CreatedAt: &p.CreatedAt,
+	}
+	if !p.UpdatedAt.IsZero() {
+		wp.UpdatedAt = &p.UpdatedAt
+	}
+	return wp
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries due by now, postponing their next attempt
+// by lease so no other instance delivers them meanwhile. Deliveries to webhooks that have since been
+// deleted are failed rather than returned. The query needs a composite index on webhook_deliveries of
+// status ascending then next_attempt_at ascending.
+func (s *Service) ClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]api.WebhookDelivery, error) {
+	col := s.client.Collection("webhook_deliveries")
+	query := col.Where("status", "==", api.DeliveryStatusPending).Where("next_attempt_at", "<=", now).OrderBy("next_attempt_at", firestore.Asc).Limit(limit)
+	var claimed []api.WebhookDelivery
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = nil
+		docSnaps, err := tx.Documents(query).GetAll()
+		if err != nil {
+			return err
+		}
+		stored := make([]webhookDelivery, len(docSnaps))
+		var refs []*firestore.DocumentRef
+		for i, docSnap := range docSnaps {
+			if err := docSnap.DataTo(&stored[i]); err != nil {
+				return err
+			}
+			ref := s.client.Collection("webhooks").Doc(stored[i].WebhookID)
+			if !slices.ContainsFunc(refs, func(r *firestore.DocumentRef) bool { return r.ID == ref.ID }) {
+				refs = append(refs, ref)
+			}
+		}
+		webhookSnaps, err := tx.GetAll(refs)
+		if err != nil {
+			return err
+		}
+		webhooks := make(map[string]*webhook, len(webhookSnaps))
+		for _, webhookSnap := range webhookSnaps {
+			if !webhookSnap.Exists() {
+				continue
+			}
+			var w webhook
+			if err := webhookSnap.DataTo(&w); err != nil {
+				return err
+			}
+			webhooks[webhookSnap.Ref.ID] = &w
+		}
+
+		for i, docSnap := range docSnaps {
+			w, ok := webhooks[stored[i].WebhookID]
+			if !ok {
+				if err := tx.Update(docSnap.Ref, []firestore.Update{
+					{Path: "status", Value: api.DeliveryStatusFailed},
+					{Path: "next_attempt_at", Value: firestore.Delete},
+					{Path: "updated_at", Value: now},
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Update(docSnap.Ref, []firestore.Update{{Path: "next_attempt_at", Value: now.Add(lease)}}); err != nil {
+				return err
+			}
+			delivery := stored[i].toAPI(docSnap.Ref.ID)
+			delivery.URL, delivery.Secret = w.URL, w.Secret
+			claimed = append(claimed, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// RecordWebhookAttempt logs an attempt to deliver and sets the delivery's status, a pending delivery is next attempted at next.
+func (s *Service) RecordWebhookAttempt(ctx context.Context, deliveryID string, attempt api.WebhookAttempt, deliveryStatus string, next time.Time) error {
+	docRef := s.client.Collection("webhook_deliveries").Doc(deliveryID)
+	updates := []firestore.Update{
+		{Path: "status", Value: deliveryStatus},
+		{Path: "attempts", Value: attempt.Attempt},
+		{Path: "updated_at", Value: attempt.At},
+		{Path: "next_attempt_at", Value: firestore.Delete},
+	}
+	if deliveryStatus == api.DeliveryStatusPending {
+		updates[len(updates)-1].Value = next
+	}
+
+	batch := s.client.Batch()
+	batch.Set(docRef.Collection("attempts").Doc(strconv.Itoa(attempt.Attempt)), webhookAttempt(attempt))
+	batch.Update(docRef, updates)
+	_, err := batch.Commit(ctx)
+	return err
+}
+
+// PurgeWebhookDeliveries permanently removes up to limit deliveries that finished before the given time,
+// along with their attempts, returning the number removed. Pending deliveries to deleted webhooks are
+// failed when next due, so they are removed too once they have been kept as long.
+// Deliveries are found by a query on status and updated_at, which needs a composite index on those fields.
+func (s *Service) PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int, error) {
+	query := s.client.Collection("webhook_deliveries").
+		Where("status", "in", []string{api.DeliveryStatusSucceeded, api.DeliveryStatusFailed}).
+		Where("updated_at", "<=", before).
+		Limit(limit)
+	docSnaps, err := query.Select().Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	bw := s.client.BulkWriter(ctx)
+	jobs := make([]*firestore.BulkWriterJob, 0, len(docSnaps))
+	for _, docSnap := range docSnaps {
+		attemptSnaps, err := docSnap.Ref.Collection("attempts").Select().Documents(ctx).GetAll()
+		if err != nil {
+			bw.End()
+			return 0, err
+		}
+		for _, attemptSnap := range attemptSnaps {
+			job, err := bw.Delete(attemptSnap.Ref)
+			if err != nil {
+				bw.End()
+				return 0, err
+			}
+			jobs = append(jobs, job)
+		}
+		job, err := bw.Delete(docSnap.Ref)
+		if err != nil {
+			bw.End()
+			return 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	bw.End()
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return 0, err
+		}
+	}
+	return len(docSnaps), nil
+}
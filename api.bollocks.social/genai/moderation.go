@@ -0,0 +1,57 @@
+package genai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// ModerationCategories are the categories content is classified against.
+var ModerationCategories = []string{"hate", "harassment", "spam", "sexual"}
+
+const moderationSystemInstruction = "You are a content moderator for a social network. For each category, score how likely the post is to contain that kind of content, from 0 (certainly not) to 1 (certainly). Respond only with a JSON object of scores."
+
+func (s *Service) moderationModel() *genai.GenerativeModel {
+	model := s.client.GenerativeModel(s.cfg.Model)
+	model.SetTemperature(0)
+	model.ResponseMIMEType = "application/json"
+	properties := make(map[string]*genai.Schema, len(ModerationCategories))
+	for _, category := range ModerationCategories {
+		properties[category] = &genai.Schema{Type: genai.TypeNumber, Description: "likelihood from 0 to 1"}
+	}
+	model.ResponseSchema = &genai.Schema{
+		Type:       genai.TypeObject,
+		Properties: properties,
+		Required:   ModerationCategories,
+	}
+	model.SystemInstruction = genai.NewUserContent(genai.Text(moderationSystemInstruction))
+	return model
+}
+
+// Classify scores content from 0 to 1 against each of the ModerationCategories.
+func (s *Service) Classify(ctx context.Context, content string) (map[string]float64, error) {
+	prompt := fmt.Sprintf("Categories: %s. Post: %q", strings.Join(ModerationCategories, ", "), content)
+	resp, err := s.generate(ctx, s.moderationBreaker, s.moderationModel(), genai.Text(prompt))
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := responseText(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var scores map[string]float64
+	if err := json.Unmarshal([]byte(stripCodeFence(text)), &scores); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal moderation scores from Gemini content: %w", err)
+	}
+	for _, category := range ModerationCategories {
+		if _, ok := scores[category]; !ok {
+			return nil, fmt.Errorf("no moderation score returned for %s", category)
+		}
+	}
+	return scores, nil
+}
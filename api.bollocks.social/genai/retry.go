@@ -0,0 +1,114 @@
+package genai
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metrics are published under "genai" at the expvar endpoint.
+var metrics = expvar.NewMap("genai")
+
+// generate calls the model guarded by the caller's circuit breaker, bounding each attempt by the configured
+// timeout and retrying transient errors with capped exponential backoff and jitter, within the configured budget.
+// Every call admitted by the breaker reports back to it, so a half-open probe is always released.
+func (s *Service) generate(ctx context.Context, b *breaker, model *genai.GenerativeModel, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	if !b.allow() {
+		metrics.Add("breaker_rejections", 1)
+		return nil, ErrCircuitOpen
+	}
+
+	var deadline time.Time
+	if s.cfg.Budget > 0 {
+		deadline = time.Now().Add(s.cfg.Budget)
+	}
+	backoff := s.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		metrics.Add("requests", 1)
+		resp, err := s.attempt(ctx, deadline, model, parts...)
+		if err == nil {
+			b.success()
+			return resp, nil
+		}
+
+		metrics.Add("failures", 1)
+		switch {
+		case ctx.Err() != nil:
+			// The caller gave up, which says nothing of Gemini's health.
+			b.release()
+			return nil, err
+		case !isTransient(ctx, err):
+			// Gemini answered, it is the request that failed.
+			b.success()
+			return nil, err
+		case attempt >= s.cfg.MaxRetries:
+			b.failure()
+			return nil, err
+		}
+
+		wait := backoff/2 + rand.N(backoff/2+1)
+		backoff = min(backoff*2, s.cfg.MaxRetryBackoff)
+		if !deadline.IsZero() && time.Until(deadline) <= wait {
+			metrics.Add("budget_exhausted", 1)
+			b.failure()
+			return nil, err
+		}
+		metrics.Add("retries", 1)
+		select {
+		case <-ctx.Done():
+			b.release()
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// attempt makes a single call to the model, bounded by the configured timeout and the deadline of the budget if set.
+func (s *Service) attempt(ctx context.Context, deadline time.Time, model *genai.GenerativeModel, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	if s.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Timeout)
+		defer cancel()
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return model.GenerateContent(ctx, parts...)
+}
+
+// isTransient reports whether err is worth retrying.
+// Deadlines are only transient when they belong to the attempt rather than the caller.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Internal, codes.Aborted:
+		return true
+	}
+	return false
+}
@@ -1,53 +1,190 @@
 package genai
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"expvar"
 	"fmt"
+	"text/template"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
 	"google.golang.org/api/option"
 )
 
+// DefaultPromptTemplate is the prompt used to generate tags when no template is configured.
+// It is executed with a struct exposing Content and MaxTags.
+const DefaultPromptTemplate = `Analyze the following text and generate up to {{.MaxTags}} relevant, single-word, lowercase tags. If any words are preceeded by a #, these should be prioritized. Text: {{printf "%q" .Content}}`
+
+// DefaultSystemInstruction is the system instruction given to the model when none is configured.
+const DefaultSystemInstruction = "You label short social media posts with topical tags. Respond only with a JSON array of strings."
+
+// Config controls which Gemini model is used to generate tags and how it is prompted.
+type Config struct {
+	Model             string
+	Temperature       float32
+	MaxTags           int
+	MinTagLength      int
+	MaxTagLength      int
+	PromptTemplate    string
+	SystemInstruction string
+
+	// Timeout bounds each attempt to call Gemini, retries get a fresh timeout.
+	Timeout    time.Duration
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled for each retry up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// Budget bounds a call including its retries, 0 to bound it only by Timeout and MaxRetries.
+	// Retries that cannot start within the budget are not made.
+	Budget time.Duration
+	// BreakerThreshold is the number of consecutive failures that opens a circuit breaker,
+	// 0 disables it. While open, calls fail fast with ErrCircuitOpen for BreakerCooldown.
+	// Tagging and moderation each have their own breaker, so one failing does not disable the other.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultConfig returns the configuration used by the service prior to it being configurable.
+func DefaultConfig() Config {
+	return Config{
+		Model:             "gemini-2.5-flash",
+		Temperature:       0.2,
+		MaxTags:           5,
+		MinTagLength:      2,
+		MaxTagLength:      32,
+		PromptTemplate:    DefaultPromptTemplate,
+		SystemInstruction: DefaultSystemInstruction,
+		Timeout:           2 * time.Second,
+		MaxRetries:        2,
+		RetryBackoff:      200 * time.Millisecond,
+		MaxRetryBackoff:   time.Second,
+		BreakerThreshold:  5,
+		BreakerCooldown:   30 * time.Second,
+	}
+}
+
+// Fingerprint returns a hex SHA-256 of the configuration that determines the tags generated for content,
+// so tags cached under a different model or prompt can be told apart.
+func (c Config) Fingerprint() string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%g\x00%d\x00%d\x00%d\x00%s\x00%s",
+		c.Model, c.Temperature, c.MaxTags, c.MinTagLength, c.MaxTagLength, c.PromptTemplate, c.SystemInstruction))
+	return hex.EncodeToString(sum[:])
+}
+
 type Service struct {
-	client *genai.Client
+	client            *genai.Client
+	cfg               Config
+	prompt            *template.Template
+	tagsBreaker       *breaker
+	moderationBreaker *breaker
 }
 
-func NewService(ctx context.Context, apiKey string) (*Service, error) {
+func NewService(ctx context.Context, apiKey string, cfg Config) (*Service, error) {
 	if apiKey == "" {
 		return nil, errors.New("no API key provided")
 	}
+	if cfg.Model == "" {
+		return nil, errors.New("no model provided")
+	}
+	if cfg.MaxTags <= 0 {
+		return nil, errors.New("max tags must be positive")
+	}
+	if cfg.MinTagLength <= 0 || cfg.MaxTagLength < cfg.MinTagLength {
+		return nil, errors.New("invalid tag length bounds")
+	}
+	if cfg.MaxRetries > 0 && (cfg.RetryBackoff <= 0 || cfg.MaxRetryBackoff < cfg.RetryBackoff) {
+		return nil, errors.New("invalid retry backoff bounds")
+	}
+
+	prompt, err := template.New("prompt").Parse(cfg.PromptTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prompt template: %w", err)
+	}
 
 	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
 		return nil, err
 	}
-	return &Service{
-		client: client,
-	}, nil
+	s := &Service{
+		client:            client,
+		cfg:               cfg,
+		prompt:            prompt,
+		tagsBreaker:       newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		moderationBreaker: newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+	metrics.Set("tags_breaker_state", expvar.Func(func() any { return s.tagsBreaker.State().String() }))
+	metrics.Set("moderation_breaker_state", expvar.Func(func() any { return s.moderationBreaker.State().String() }))
+	return s, nil
+}
+
+// TagsCheck reports readiness of Gemini for tagging.
+// An open circuit is a warning rather than a failure as posts are still tagged from hashtags.
+func (s *Service) TagsCheck(ctx context.Context) (string, string) {
+	return breakerCheck(s.tagsBreaker)
+}
+
+// ModerationCheck reports readiness of Gemini for moderation.
+// An open circuit is a warning rather than a failure as posts are then handled as the moderator is configured to.
+func (s *Service) ModerationCheck(ctx context.Context) (string, string) {
+	return breakerCheck(s.moderationBreaker)
+}
+
+func breakerCheck(b *breaker) (string, string) {
+	state := b.State()
+	if state == BreakerClosed {
+		return "pass", state.String()
+	}
+	return "warn", state.String()
+}
+
+// model returns a generative model configured to respond with a JSON array of tags.
+func (s *Service) model() *genai.GenerativeModel {
+	model := s.client.GenerativeModel(s.cfg.Model)
+	model.SetTemperature(s.cfg.Temperature)
+	model.ResponseMIMEType = "application/json"
+	model.ResponseSchema = &genai.Schema{
+		Type:        genai.TypeArray,
+		Description: fmt.Sprintf("between 1 and %d single-word, lowercase tags", s.cfg.MaxTags),
+		Items:       &genai.Schema{Type: genai.TypeString},
+	}
+	if s.cfg.SystemInstruction != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(s.cfg.SystemInstruction))
+	}
+	return model
 }
 
 func (s *Service) GenerateTags(ctx context.Context, content string) ([]string, error) {
-	prompt := fmt.Sprintf("Analyze the following text and generate 3-5 relevant, single-word, lowercase tags. Return the tags as a JSON array of strings. Do not include any other text or markdown in your response. If any words are preceeded by a #, these should be prioritized. Text: \"%s\"", content)
+	var prompt bytes.Buffer
+	err := s.prompt.Execute(&prompt, struct {
+		Content string
+		MaxTags int
+	}{content, s.cfg.MaxTags})
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute prompt template: %w", err)
+	}
 
-	model := s.client.GenerativeModel("gemini-2.5-flash")
-	resp, err := model.GenerateContent(ctx, genai.Text(prompt))
+	resp, err := s.generate(ctx, s.tagsBreaker, s.model(), genai.Text(prompt.String()))
 	if err != nil {
 		return nil, err
 	}
 
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, errors.New("no content returned from Gemini")
+	text, err := responseText(resp)
+	if err != nil {
+		return nil, err
 	}
 
-	// Clean up the response text which might be wrapped in markdown
-	responseText := resp.Candidates[0].Content.Parts[0].(genai.Text)
-
-	var tags []string
-	if err := json.Unmarshal([]byte(responseText), &tags); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal tags from Gemini content: %w", err)
+	generated, err := unmarshalTags(text)
+	if err != nil {
+		return nil, err
 	}
 
+	tags := s.mergeTags(content, generated)
+	if len(tags) == 0 {
+		return nil, errors.New("no valid tags returned from Gemini")
+	}
 	return tags, nil
 }
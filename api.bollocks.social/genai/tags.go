@@ -0,0 +1,103 @@
+package genai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/entities"
+)
+
+// Hashtags extracts the explicit hashtags from content, lowercased, sorted and de-duplicated.
+func Hashtags(content string) []string {
+	return entities.Hashtags(content)
+}
+
+// responseText concatenates all text parts of the first candidate, ignoring any non-text parts.
+func responseText(resp *genai.GenerateContentResponse) (string, error) {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return "", errors.New("no content returned from Gemini")
+	}
+
+	var b strings.Builder
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if text, ok := part.(genai.Text); ok {
+			b.WriteString(string(text))
+		}
+	}
+	if b.Len() == 0 {
+		return "", errors.New("no text content returned from Gemini")
+	}
+	return b.String(), nil
+}
+
+// stripCodeFence removes a markdown code fence wrapping text, if there is one.
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	rest, ok := strings.CutPrefix(text, "```")
+	if !ok {
+		return text
+	}
+	// Drop the info string, e.g. ```json
+	if i := strings.IndexByte(rest, '\n'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	rest, _ = strings.CutSuffix(strings.TrimSpace(rest), "```")
+	return strings.TrimSpace(rest)
+}
+
+// unmarshalTags decodes a JSON array of tags from text which may be wrapped in a
+// markdown code fence or surrounded by prose.
+func unmarshalTags(text string) ([]string, error) {
+	text = stripCodeFence(text)
+
+	var tags []string
+	err := json.Unmarshal([]byte(text), &tags)
+	if err == nil {
+		return tags, nil
+	}
+
+	start, end := strings.IndexByte(text, '['), strings.LastIndexByte(text, ']')
+	if start >= 0 && end > start {
+		if json.Unmarshal([]byte(text[start:end+1]), &tags) == nil {
+			return tags, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to unmarshal tags from Gemini content: %w", err)
+}
+
+// normalizeTag lowercases a tag and reports whether it is a single word within the configured length bounds.
+func (s *Service) normalizeTag(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	n := utf8.RuneCountInString(tag)
+	if n < s.cfg.MinTagLength || n > s.cfg.MaxTagLength {
+		return "", false
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_' {
+			return "", false
+		}
+	}
+	return tag, true
+}
+
+// mergeTags validates and de-duplicates tags, giving explicit hashtags from content
+// priority over generated tags, and caps the result at the configured maximum.
+func (s *Service) mergeTags(content string, generated []string) []string {
+	tags := make([]string, 0, s.cfg.MaxTags)
+	for _, tag := range slices.Concat(Hashtags(content), generated) {
+		if len(tags) == s.cfg.MaxTags {
+			break
+		}
+		tag, ok := s.normalizeTag(tag)
+		if ok && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
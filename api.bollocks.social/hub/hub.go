@@ -0,0 +1,246 @@
+// Package hub fans out stored changes to live connections. Each post or user with subscribers, and the feed,
+// is watched once per instance through the Source, so connections receive changes made through any instance.
+package hub
+
+import (
+	"context"
+	"expvar"
+	"sync"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// metrics are published under "hub" at the expvar endpoint.
+var metrics = expvar.NewMap("hub")
+
+// Source watches the stored changes published to subscriptions.
+type Source interface {
+	// WatchLikes calls publish with the like count of a post each time it changes, until ctx is done.
+	WatchLikes(ctx context.Context, postID string, publish func(api.LikeCount)) error
+	// WatchNotifications calls publish with each notification for a user from now on, until ctx is done.
+	WatchNotifications(ctx context.Context, userID string, publish func(api.Notification)) error
+	// WatchPosts calls publish with each post published from now on, and with each of them removed
+	// from the feed, until ctx is done.
+	WatchPosts(ctx context.Context, publish func(api.FeedPost)) error
+}
+
+// feedTopic is the key of the feed, which has a single topic.
+const feedTopic = "feed"
+
+type Config struct {
+	// Buffer is the number of events queued for a subscription before it is dropped for falling behind.
+	Buffer int
+}
+
+// Hub is an api.Hub routing like counts to subscribers of the post and notifications to their recipient.
+type Hub struct {
+	logger log.Logger
+	source Source
+	cfg    Config
+
+	mu            sync.Mutex
+	posts         map[string]*topic
+	notifications map[string]*topic
+	feed          map[string]*topic
+}
+
+// topic is a post or user with subscribers, it is watched for as long as it has any.
+type topic struct {
+	subs    map[*subscription]struct{}
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+func NewHub(logger log.Logger, source Source, cfg Config) *Hub {
+	return &Hub{
+		logger:        logger,
+		source:        source,
+		cfg:           cfg,
+		posts:         make(map[string]*topic),
+		notifications: make(map[string]*topic),
+		feed:          make(map[string]*topic),
+	}
+}
+
+func (h *Hub) Subscribe(userID string) api.Subscription {
+	metrics.Add("subscriptions", 1)
+	return &subscription{
+		hub:    h,
+		userID: userID,
+		events: make(chan api.Event, max(h.cfg.Buffer, 1)),
+		posts:  make(map[string]bool),
+	}
+}
+
+// join adds sub to the topic key, starting to watch it if sub is its first subscriber. h.mu must be held.
+func (h *Hub) join(topics map[string]*topic, key string, sub *subscription, watch func(ctx context.Context, publish func(api.Event)) error) {
+	t := topics[key]
+	if t == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		t = &topic{subs: make(map[*subscription]struct{}), cancel: cancel}
+		topics[key] = t
+		metrics.Add("topics", 1)
+		go func() {
+			err := watch(ctx, func(event api.Event) { h.publish(t, event) })
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if t.stopped {
+				return
+			}
+			metrics.Add("errors", 1)
+			h.logger.Log("failed to watch live updates", "error", err, "topic", key)
+			// Subscribers are dropped so their clients reconnect, and the topic is watched again.
+			for sub := range t.subs {
+				h.remove(sub)
+			}
+		}()
+	}
+	t.subs[sub] = struct{}{}
+}
+
+// leave removes sub from the topic key, no longer watching it once it has no subscribers. h.mu must be held.
+func (h *Hub) leave(topics map[string]*topic, key string, sub *subscription) {
+	t := topics[key]
+	if t == nil {
+		return
+	}
+	delete(t.subs, sub)
+	if len(t.subs) == 0 {
+		t.stopped = true
+		t.cancel()
+		delete(topics, key)
+		metrics.Add("topics", -1)
+	}
+}
+
+// publish queues an event for each subscriber to a topic, dropping subscriptions whose queue is full
+// rather than blocking the topic's watcher.
+func (h *Hub) publish(t *topic, event api.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	metrics.Add("published", 1)
+	for sub := range t.subs {
+		select {
+		case sub.events <- event:
+			metrics.Add("delivered", 1)
+		default:
+			metrics.Add("dropped", 1)
+			h.remove(sub)
+		}
+	}
+}
+
+func (h *Hub) watchLikes(postID string) func(ctx context.Context, publish func(api.Event)) error {
+	return func(ctx context.Context, publish func(api.Event)) error {
+		return h.source.WatchLikes(ctx, postID, func(count api.LikeCount) {
+			publish(api.Event{Type: api.EventLikes, Likes: &count})
+		})
+	}
+}
+
+func (h *Hub) watchNotifications(userID string) func(ctx context.Context, publish func(api.Event)) error {
+	return func(ctx context.Context, publish func(api.Event)) error {
+		return h.source.WatchNotifications(ctx, userID, func(n api.Notification) {
+			publish(api.Event{Type: api.EventNotification, Notification: &n})
+		})
+	}
+}
+
+func (h *Hub) watchFeed(ctx context.Context, publish func(api.Event)) error {
+	return h.source.WatchPosts(ctx, func(p api.FeedPost) {
+		publish(api.Event{Type: api.EventPost, Post: &p})
+	})
+}
+
+// remove closes a subscription and stops routing events to it, h.mu must be held.
+func (h *Hub) remove(sub *subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	for postID := range sub.posts {
+		h.leave(h.posts, postID, sub)
+	}
+	if sub.notifications {
+		h.leave(h.notifications, sub.userID, sub)
+	}
+	if sub.feed {
+		h.leave(h.feed, feedTopic, sub)
+	}
+	close(sub.events)
+	metrics.Add("subscriptions", -1)
+}
+
+// subscription is an api.Subscription, its fields other than events are guarded by the hub's mutex.
+type subscription struct {
+	hub    *Hub
+	userID string
+	events chan api.Event
+
+	posts         map[string]bool
+	notifications bool
+	feed          bool
+	closed        bool
+}
+
+func (s *subscription) Events() <-chan api.Event {
+	return s.events
+}
+
+func (s *subscription) SubscribePost(postID string) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.closed || s.posts[postID] {
+		return
+	}
+	s.posts[postID] = true
+	s.hub.join(s.hub.posts, postID, s, s.hub.watchLikes(postID))
+}
+
+func (s *subscription) UnsubscribePost(postID string) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.closed || !s.posts[postID] {
+		return
+	}
+	delete(s.posts, postID)
+	s.hub.leave(s.hub.posts, postID, s)
+}
+
+func (s *subscription) SetNotifications(on bool) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.closed || s.notifications == on {
+		return
+	}
+	s.notifications = on
+	if on {
+		s.hub.join(s.hub.notifications, s.userID, s, s.hub.watchNotifications(s.userID))
+	} else {
+		s.hub.leave(s.hub.notifications, s.userID, s)
+	}
+}
+
+func (s *subscription) SetFeed(on bool) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.closed || s.feed == on {
+		return
+	}
+	s.feed = on
+	if on {
+		s.hub.join(s.hub.feed, feedTopic, s, s.hub.watchFeed)
+	} else {
+		s.hub.leave(s.hub.feed, feedTopic, s)
+	}
+}
+
+func (s *subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
@@ -0,0 +1,92 @@
+package linkpreview
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	maxTitleLength       = 300
+	maxDescriptionLength = 500
+)
+
+// parsePreview reads the OpenGraph metadata from the head of an HTML document,
+// falling back to the Twitter card, description and title of the page.
+func parsePreview(pageURL *url.URL, r io.Reader) api.LinkPreview {
+	meta := make(map[string]string)
+	var title string
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		name, hasAttr := z.TagName()
+		switch a := atom.Lookup(name); {
+		case tt == html.EndTagToken && a == atom.Head, tt == html.StartTagToken && a == atom.Body:
+			// Metadata is only read from the head.
+			return buildPreview(pageURL, meta, title)
+		case (tt == html.StartTagToken || tt == html.SelfClosingTagToken) && a == atom.Meta && hasAttr:
+			var key, content string
+			for more := true; more; {
+				var k, v []byte
+				k, v, more = z.TagAttr()
+				switch string(k) {
+				case "property", "name":
+					key = strings.ToLower(string(v))
+				case "content":
+					content = string(v)
+				}
+			}
+			if _, ok := meta[key]; !ok && key != "" {
+				meta[key] = strings.TrimSpace(content)
+			}
+		case tt == html.StartTagToken && a == atom.Title && title == "":
+			if z.Next() == html.TextToken {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		}
+	}
+	return buildPreview(pageURL, meta, title)
+}
+
+func buildPreview(pageURL *url.URL, meta map[string]string, title string) api.LinkPreview {
+	p := api.LinkPreview{
+		URL:         pageURL.String(),
+		Title:       truncate(first(meta["og:title"], meta["twitter:title"], title), maxTitleLength),
+		Description: truncate(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength),
+		SiteName:    truncate(meta["og:site_name"], maxTitleLength),
+	}
+	if image := first(meta["og:image"], meta["og:image:url"], meta["twitter:image"]); image != "" {
+		if u, err := pageURL.Parse(image); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			p.ImageURL = u.String()
+		}
+	}
+	return p
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "…"
+}
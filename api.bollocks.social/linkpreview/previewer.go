@@ -0,0 +1,196 @@
+// Package linkpreview unfurls URLs in posts into previews built from the linked page's OpenGraph metadata.
+package linkpreview
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/publichttp"
+	"github.com/mchipperfield/gocore/log"
+	"golang.org/x/net/html/charset"
+)
+
+// metrics are published under "link_previews" at the expvar endpoint.
+var metrics = expvar.NewMap("link_previews")
+
+// failureTTL is how long a URL that could not be previewed is remembered, so it is not refetched for every post.
+const failureTTL = 5 * time.Minute
+
+type Config struct {
+	// Timeout bounds previewing all the URLs in a post, including redirects.
+	Timeout time.Duration
+	// MaxURLs is the number of URLs previewed per post.
+	MaxURLs int
+	// MaxBodySize is the number of bytes of a page read looking for its metadata.
+	MaxBodySize int64
+	// MaxRedirects is the number of redirects followed per URL.
+	MaxRedirects int
+	UserAgent    string
+	// CacheSize is the number of previews cached in memory, and CacheTTL how long they are kept.
+	CacheSize int
+	CacheTTL  time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Timeout:      3 * time.Second,
+		MaxURLs:      3,
+		MaxBodySize:  512 << 10,
+		MaxRedirects: 3,
+		UserAgent:    "bollocks.social-linkpreview/1.0",
+		CacheSize:    1000,
+		CacheTTL:     time.Hour,
+	}
+}
+
+// Previewer is an api.Previewer fetching pages over a client restricted to public addresses.
+type Previewer struct {
+	logger log.Logger
+	client *http.Client
+	cfg    Config
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	url string
+	// preview is nil if the URL could not be previewed.
+	preview *api.LinkPreview
+	expires time.Time
+}
+
+func NewPreviewer(logger log.Logger, cfg Config) *Previewer {
+	return &Previewer{
+		logger:  logger,
+		client:  publichttp.NewClient(cfg.Timeout, cfg.MaxRedirects),
+		cfg:     cfg,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Previews returns previews of the URLs in content, in the order they appear.
+// URLs that cannot be previewed in time are left out.
+func (p *Previewer) Previews(ctx context.Context, content string) []api.LinkPreview {
+	urls := FindURLs(content, p.cfg.MaxURLs)
+	if len(urls) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	results := make([]*api.LinkPreview, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Go(func() { results[i] = p.preview(ctx, u) })
+	}
+	wg.Wait()
+
+	var previews []api.LinkPreview
+	for _, preview := range results {
+		if preview != nil {
+			previews = append(previews, *preview)
+		}
+	}
+	return previews
+}
+
+func (p *Previewer) preview(ctx context.Context, rawURL string) *api.LinkPreview {
+	if preview, ok := p.get(rawURL); ok {
+		metrics.Add("hits", 1)
+		return preview
+	}
+
+	metrics.Add("misses", 1)
+	preview, err := p.fetch(ctx, rawURL)
+	if err != nil {
+		metrics.Add("errors", 1)
+		p.logger.Log("failed to preview link", "error", err, "url", rawURL)
+		// Failures caused by the post's deadline say nothing about the URL, so are not remembered.
+		if ctx.Err() != nil {
+			return nil
+		}
+		p.add(rawURL, nil, failureTTL)
+		return nil
+	}
+	p.add(rawURL, preview, p.cfg.CacheTTL)
+	return preview
+}
+
+func (p *Previewer) fetch(ctx context.Context, rawURL string) (*api.LinkPreview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", p.cfg.UserAgent)
+	req.Header.Set("Accept", "text/html")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "text/html" {
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+	body, err := charset.NewReader(io.LimitReader(resp.Body, p.cfg.MaxBodySize), contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	// The preview links to the URL in the post, but relative images resolve against the final page.
+	preview := parsePreview(resp.Request.URL, body)
+	preview.URL = rawURL
+	if preview.Title == "" && preview.Description == "" {
+		return nil, fmt.Errorf("no metadata found")
+	}
+	return &preview, nil
+}
+
+func (p *Previewer) get(rawURL string) (*api.LinkPreview, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[rawURL]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		p.lru.Remove(e)
+		delete(p.entries, rawURL)
+		return nil, false
+	}
+	p.lru.MoveToFront(e)
+	return entry.preview, true
+}
+
+func (p *Previewer) add(rawURL string, preview *api.LinkPreview, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry := &cacheEntry{url: rawURL, preview: preview, expires: time.Now().Add(ttl)}
+	if e, ok := p.entries[rawURL]; ok {
+		e.Value = entry
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.entries[rawURL] = p.lru.PushFront(entry)
+	for p.lru.Len() > p.cfg.CacheSize {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.entries, oldest.Value.(*cacheEntry).url)
+	}
+}
@@ -0,0 +1,9 @@
+package linkpreview
+
+import "github.com/mchipperfield/bollocks/api.bollocks.social/entities"
+
+// FindURLs returns up to max distinct http and https URLs in content, in the order they appear.
+func FindURLs(content string, max int) []string {
+	urls := entities.URLs(content)
+	return urls[:min(len(urls), max)]
+}
@@ -8,18 +8,34 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	firebase "firebase.google.com/go"
-	"github.com/gorilla/handlers"
 	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/counting"
 	"github.com/mchipperfield/bollocks/api.bollocks.social/firestore"
 	"github.com/mchipperfield/bollocks/api.bollocks.social/genai"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/hub"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/linkpreview"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/media"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/moderation"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/purging"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/scheduling"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/tagging"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/webhooks"
 )
 
 const (
 	Service string = "api.bollocks.social"
+
+	writeTimeout = 10 * time.Second
+	// writeReserve is the part of the write timeout kept for reading the request and writing the post,
+	// rather than given to Gemini.
+	writeReserve = 2 * time.Second
 )
 
 func main() {
@@ -31,13 +47,90 @@ func main() {
 	flags := flag.NewFlagSet("", flag.ContinueOnError)
 	var (
 		port         = flags.Int("port", 8080, "port for API to listen on")
-		geminiAPIKey = flags.String("gemini-api-key", "", "API key for the Google Gemini service")
+		geminiAPIKey = flags.String("gemini-api-key", "", "API key for the Google Gemini service, read from GEMINI_API_KEY if not set")
+
+		geminiModel              = flags.String("gemini-model", genai.DefaultConfig().Model, "Gemini model used to generate tags")
+		geminiTemperature        = flags.Float64("gemini-temperature", float64(genai.DefaultConfig().Temperature), "sampling temperature used when generating tags")
+		geminiMaxTags            = flags.Int("gemini-max-tags", genai.DefaultConfig().MaxTags, "maximum number of tags generated for a post")
+		geminiPromptTemplateFile = flags.String("gemini-prompt-template-file", "", "path to a text/template file used as the tag generation prompt, executed with .Content and .MaxTags")
+		geminiSystemInstruction  = flags.String("gemini-system-instruction", genai.DefaultConfig().SystemInstruction, "system instruction given to the Gemini model")
+		geminiTimeout            = flags.Duration("gemini-timeout", genai.DefaultConfig().Timeout, "deadline for each call to Gemini")
+		geminiMaxRetries         = flags.Int("gemini-max-retries", genai.DefaultConfig().MaxRetries, "number of times a transient Gemini error is retried")
+		geminiRetryBackoff       = flags.Duration("gemini-retry-backoff", genai.DefaultConfig().RetryBackoff, "initial backoff between Gemini retries, doubled on each retry")
+		geminiMaxRetryBackoff    = flags.Duration("gemini-max-retry-backoff", genai.DefaultConfig().MaxRetryBackoff, "longest backoff between Gemini retries")
+		geminiBreakerThreshold   = flags.Int("gemini-breaker-threshold", genai.DefaultConfig().BreakerThreshold, "consecutive Gemini failures before tagging falls back to hashtags or moderation is skipped, counted separately for each, 0 to disable")
+		geminiBreakerCooldown    = flags.Duration("gemini-breaker-cooldown", genai.DefaultConfig().BreakerCooldown, "how long Gemini is skipped once a circuit breaker opens")
+
+		asyncTagging         = flags.Bool("async-tagging", false, "store posts with hashtag tags and generate AI tags in the background")
+		tagWorkers           = flags.Int("tag-workers", 2, "number of background tag generation workers")
+		tagQueueSize         = flags.Int("tag-queue-size", 100, "number of posts that can wait for background tag generation")
+		tagQueuePollInterval = flags.Duration("tag-queue-poll-interval", time.Minute, "how often firestore is polled for posts with pending tags, 0 to only use the in-process queue")
+
+		tagCacheSize      = flags.Int("tag-cache-size", 1000, "number of generated tag results cached in memory by content hash, 0 to disable caching")
+		tagCacheFirestore = flags.Bool("tag-cache-firestore", false, "also cache generated tags in firestore, shared between instances")
+		tagCacheTTL       = flags.Duration("tag-cache-ttl", 7*24*time.Hour, "how long cached tags are reused before they are generated again, 0 to reuse them until evicted")
+
+		moderationEnabled             = flags.Bool("moderation", false, "classify posts with Gemini before they are published")
+		moderationQuarantineThreshold = flags.Float64("moderation-quarantine-threshold", 0.7, "score from 0 to 1 at which a post is withheld from the feed, 0 to never quarantine")
+		moderationRejectThreshold     = flags.Float64("moderation-reject-threshold", 0.9, "score from 0 to 1 at which a post is rejected, 0 to never reject")
+		moderationCategoryThresholds  = flags.String("moderation-category-thresholds", "", "comma separated per category overrides of the form category=quarantine:reject, e.g. spam=0.8:0.95")
+		moderationFailClosed          = flags.Bool("moderation-fail-closed", false, "quarantine posts when they cannot be classified rather than publishing them unchecked")
+
+		linkPreviews         = flags.Bool("link-previews", false, "fetch previews of URLs in posts when they are written")
+		linkPreviewTimeout   = flags.Duration("link-preview-timeout", linkpreview.DefaultConfig().Timeout, "deadline for previewing all the URLs in a post")
+		linkPreviewCacheSize = flags.Int("link-preview-cache-size", linkpreview.DefaultConfig().CacheSize, "number of link previews cached in memory")
+		linkPreviewCacheTTL  = flags.Duration("link-preview-cache-ttl", linkpreview.DefaultConfig().CacheTTL, "how long a link preview is cached")
+
+		mediaStorage       = flags.String("media-storage", "", "where uploaded attachments are stored, local or gcs, empty to disable attachments")
+		mediaLocalDir      = flags.String("media-local-dir", "media", "directory attachments are stored in and served from with local media storage")
+		mediaBucket        = flags.String("media-bucket", "", "Cloud Storage bucket attachments are stored in with gcs media storage")
+		mediaBaseURL       = flags.String("media-base-url", "", "URL attachments are served from, defaults to /media for local storage and the public bucket URL for gcs")
+		mediaMaxSize       = flags.Int64("media-max-size", 10<<20, "largest attachment in bytes that may be uploaded")
+		mediaAllowedTypes  = flags.String("media-allowed-types", strings.Join(media.DefaultAllowedTypes, ","), "comma separated list of content types that may be uploaded")
+		mediaThumbnailSize = flags.Int("media-thumbnail-size", 320, "width and height in pixels that image thumbnails fit within")
+		mediaUploadExpiry  = flags.Duration("media-upload-expiry", 15*time.Minute, "how long an upload URL is valid for")
+
+		likeShards          = flags.Int("like-shards", 10, "number of shards each post's like counter is split across, may be increased but never reduced")
+		likeCountInterval   = flags.Duration("like-count-interval", 10*time.Second, "how often the like counts shown in lists of posts are updated")
+		scheduleInterval    = flags.Duration("schedule-interval", time.Minute, "how often scheduled posts that are due are published")
+		restoreWindow       = flags.Duration("restore-window", 24*time.Hour, "how long after deletion a post may be restored by its author, 0 to allow restores until it is purged")
+		deletedRetention    = flags.Duration("deleted-post-retention", 30*24*time.Hour, "how long deleted posts are kept before they are permanently removed, 0 to never remove them")
+		purgeInterval       = flags.Duration("purge-interval", time.Hour, "how often deleted posts and webhook deliveries past their retention are permanently removed")
+		editWindow          = flags.Duration("edit-window", 0, "how long after creation a post may be edited, 0 to allow edits forever")
+		streamHeartbeat     = flags.Duration("stream-heartbeat", 15*time.Second, "how often a heartbeat is sent on idle feed streams and websockets, shorter than any proxy's idle timeout")
+		wsBuffer            = flags.Int("ws-buffer", 64, "number of events queued for a websocket before it is disconnected for falling behind")
+		accountCacheTTL     = flags.Duration("account-cache-ttl", 30*time.Second, "how long the account loaded for each request is cached, bans and roles changed through another instance take up to this long to apply, 0 to disable caching")
+		reportHideThreshold = flags.Int("report-hide-threshold", 5, "number of user reports after which a post is hidden from the feed, 0 to never hide")
+
+		webhookInterval    = flags.Duration("webhook-interval", webhooks.DefaultConfig().Interval, "how often due webhook deliveries are made")
+		webhookTimeout     = flags.Duration("webhook-timeout", webhooks.DefaultConfig().Timeout, "deadline for each attempt to deliver to a webhook")
+		webhookMaxAttempts = flags.Int("webhook-max-attempts", webhooks.DefaultConfig().MaxAttempts, "number of attempts made to deliver to a webhook before the delivery fails")
+		webhookBackoff     = flags.Duration("webhook-backoff", webhooks.DefaultConfig().Backoff, "wait before the first retry of a webhook delivery, doubled on each retry")
+		webhookMaxBackoff  = flags.Duration("webhook-max-backoff", webhooks.DefaultConfig().MaxBackoff, "longest wait between retries of a webhook delivery")
+		webhookRetention   = flags.Duration("webhook-delivery-retention", 30*24*time.Hour, "how long finished webhook deliveries and their attempts are kept before they are permanently removed, 0 to never remove them")
+
+		corsAllowedOrigins   = flags.String("cors-allowed-origins", "http://localhost:5173", "comma separated list of origins allowed to call the API, wildcard subdomains such as https://*.example.com are supported")
+		corsAllowedMethods   = flags.String("cors-allowed-methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS", "comma separated list of methods allowed for cross-origin requests")
+		corsAllowedHeaders   = flags.String("cors-allowed-headers", "Authorization,Content-Type,If-Match", "comma separated list of headers allowed on cross-origin requests")
+		corsExposedHeaders   = flags.String("cors-exposed-headers", "Location,ETag,X-Request-ID", "comma separated list of response headers exposed to cross-origin clients")
+		corsAllowCredentials = flags.Bool("cors-allow-credentials", false, "allow credentials on cross-origin requests")
+		corsMaxAge           = flags.Int("cors-max-age", 0, "seconds a preflight response may be cached by the client, 0 to disable")
 	)
 
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		logger.Log("Failed to parse flags", "error", err)
 		os.Exit(1)
 	}
+	// Intervals drive tickers, which cannot tick at non-positive intervals.
+	if err := requirePositive(flags, "schedule-interval", "purge-interval", "stream-heartbeat", "webhook-interval", "like-count-interval"); err != nil {
+		logger.Log("invalid flag", "error", err)
+		os.Exit(1)
+	}
+	// Backoffs are jittered by drawing from a range that must not be empty.
+	if err := requirePositive(flags, "gemini-retry-backoff", "gemini-max-retry-backoff", "webhook-backoff", "webhook-max-backoff"); err != nil {
+		logger.Log("invalid flag", "error", err)
+		os.Exit(1)
+	}
 
 	firebaseApp, err := firebase.NewApp(context.Background(), nil)
 	if err != nil {
@@ -54,7 +147,43 @@ func main() {
 		logger.Log("failed to create firestore client", "error", err)
 		os.Exit(1)
 	}
-	ai, err := genai.NewService(context.Background(), *geminiAPIKey)
+	aiConfig := genai.DefaultConfig()
+	aiConfig.Model = *geminiModel
+	aiConfig.Temperature = float32(*geminiTemperature)
+	aiConfig.MaxTags = *geminiMaxTags
+	aiConfig.SystemInstruction = *geminiSystemInstruction
+	aiConfig.Timeout = *geminiTimeout
+	aiConfig.MaxRetries = *geminiMaxRetries
+	aiConfig.RetryBackoff = *geminiRetryBackoff
+	aiConfig.MaxRetryBackoff = *geminiMaxRetryBackoff
+	aiConfig.BreakerThreshold = *geminiBreakerThreshold
+	aiConfig.BreakerCooldown = *geminiBreakerCooldown
+	if *geminiPromptTemplateFile != "" {
+		b, err := os.ReadFile(*geminiPromptTemplateFile)
+		if err != nil {
+			logger.Log("failed to read prompt template", "error", err, "path", *geminiPromptTemplateFile)
+			os.Exit(1)
+		}
+		aiConfig.PromptTemplate = string(b)
+	}
+	// A post is moderated, then tagged unless tagging is asynchronous, then its links are previewed, all within
+	// the write timeout. Each call to Gemini gets an equal share of what is left after previews and writeReserve.
+	aiConfig.Budget = writeTimeout - writeReserve
+	if *linkPreviews {
+		aiConfig.Budget -= *linkPreviewTimeout
+	}
+	if calls := btoi(*moderationEnabled) + btoi(!*asyncTagging); calls > 0 {
+		aiConfig.Budget /= time.Duration(calls)
+	}
+	if aiConfig.Budget <= 0 {
+		logger.Log("invalid flag", "error", "-link-preview-timeout leaves no time to call Gemini within the write timeout")
+		os.Exit(1)
+	}
+	// The API key may be given in the environment instead, so it is not exposed in the process's arguments.
+	if *geminiAPIKey == "" {
+		*geminiAPIKey = os.Getenv("GEMINI_API_KEY")
+	}
+	ai, err := genai.NewService(context.Background(), *geminiAPIKey, aiConfig)
 	if err != nil {
 		logger.Log("failed to create AI service", "error", err)
 		os.Exit(1)
@@ -63,24 +192,189 @@ func main() {
 
 	panicMw := api.PanicMw(logger)
 
-	corsMw := handlers.CORS(
-		handlers.AllowedOrigins([]string{"http://localhost:5173"}),
-		handlers.AllowedMethods([]string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"}),
-		handlers.AllowedHeaders([]string{"Authorization", "Content-Type"}),
-	)
+	corsMw := api.CORS(api.CORSConfig{
+		AllowedOrigins:   splitList(*corsAllowedOrigins),
+		AllowedMethods:   splitList(*corsAllowedMethods),
+		AllowedHeaders:   splitList(*corsAllowedHeaders),
+		ExposedHeaders:   splitList(*corsExposedHeaders),
+		AllowCredentials: *corsAllowCredentials,
+		MaxAge:           *corsMaxAge,
+	})
 
 	loggingMw := api.LoggingMiddleware(logger)
 
-	service := firestore.NewService(client)
-	mux := api.NewHandler(logger, service, ai)
+	service := firestore.NewService(client, firestore.Config{
+		ReportHideThreshold: *reportHideThreshold,
+		LikeShards:          *likeShards,
+		EditWindow:          *editWindow,
+		RestoreWindow:       *restoreWindow,
+		AccountCacheTTL:     *accountCacheTTL,
+	})
+	liveHub := hub.NewHub(logger, service, hub.Config{Buffer: *wsBuffer})
+
+	// background work runs until the server has shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var background sync.WaitGroup
+
+	var tagger api.Tagger = ai
+	if *tagCacheSize > 0 {
+		var store tagging.CacheStore
+		if *tagCacheFirestore {
+			store = service
+		}
+		tagger = tagging.NewCache(logger, ai, store, tagging.CacheConfig{
+			Size:    *tagCacheSize,
+			TTL:     *tagCacheTTL,
+			Version: aiConfig.Fingerprint(),
+		})
+	}
+
+	var tagQueue api.TagQueue
+	if *asyncTagging {
+		q := tagging.NewQueue(logger, tagger, service, tagging.Config{
+			Workers:      *tagWorkers,
+			Size:         *tagQueueSize,
+			PollInterval: *tagQueuePollInterval,
+		})
+		background.Go(func() { q.Run(ctx) })
+		tagQueue = q
+	}
+
+	scheduler := scheduling.NewScheduler(logger, service, scheduling.Config{
+		Interval:  *scheduleInterval,
+		BatchSize: 100,
+	})
+	background.Go(func() { scheduler.Run(ctx) })
+
+	counter := counting.NewCounter(logger, service, counting.Config{
+		Interval:  *likeCountInterval,
+		BatchSize: 100,
+	})
+	background.Go(func() { counter.Run(ctx) })
+
+	webhookCfg := webhooks.DefaultConfig()
+	webhookCfg.Interval = *webhookInterval
+	webhookCfg.Timeout = *webhookTimeout
+	webhookCfg.MaxAttempts = *webhookMaxAttempts
+	webhookCfg.Backoff = *webhookBackoff
+	webhookCfg.MaxBackoff = *webhookMaxBackoff
+	deliverer := webhooks.NewDeliverer(logger, service, webhookCfg)
+	background.Go(func() { deliverer.Run(ctx) })
+
+	if *deletedRetention > 0 || *webhookRetention > 0 {
+		purger := purging.NewPurger(logger, service, purging.Config{
+			Retention:         *deletedRetention,
+			DeliveryRetention: *webhookRetention,
+			Interval:          *purgeInterval,
+			BatchSize:         100,
+		})
+		background.Go(func() { purger.Run(ctx) })
+	}
+
+	var moderator api.Moderator
+	if *moderationEnabled {
+		thresholds, err := moderationThresholds(*moderationQuarantineThreshold, *moderationRejectThreshold, *moderationCategoryThresholds)
+		if err != nil {
+			logger.Log("failed to parse moderation thresholds", "error", err)
+			os.Exit(1)
+		}
+		moderator = moderation.NewModerator(logger, ai, moderation.Config{
+			Thresholds: thresholds,
+			FailClosed: *moderationFailClosed,
+		})
+	}
+
+	var mediaSvc api.Media
+	var mediaStore media.Store
+	baseURL := *mediaBaseURL
+	switch *mediaStorage {
+	case "":
+	case "local":
+		mediaStore = media.NewLocalStore(*mediaLocalDir)
+		if baseURL == "" {
+			baseURL = "/media"
+		}
+	case "gcs":
+		storageClient, err := firebaseApp.Storage(context.Background())
+		if err != nil {
+			logger.Log("failed to create storage client", "error", err)
+			os.Exit(1)
+		}
+		bucket, err := storageClient.Bucket(*mediaBucket)
+		if err != nil {
+			logger.Log("failed to get media bucket", "error", err, "bucket", *mediaBucket)
+			os.Exit(1)
+		}
+		mediaStore = media.NewGCSStore(bucket)
+		if baseURL == "" {
+			baseURL = "https://storage.googleapis.com/" + *mediaBucket
+		}
+	default:
+		logger.Log("unknown media storage", "media_storage", *mediaStorage)
+		os.Exit(1)
+	}
+	if mediaStore != nil {
+		mediaSvc = media.NewMedia(logger, mediaStore, service, media.Config{
+			BaseURL:       baseURL,
+			MaxSize:       *mediaMaxSize,
+			AllowedTypes:  splitList(*mediaAllowedTypes),
+			ThumbnailSize: *mediaThumbnailSize,
+			UploadExpiry:  *mediaUploadExpiry,
+		})
+	}
+
+	var previewer api.Previewer
+	if *linkPreviews {
+		cfg := linkpreview.DefaultConfig()
+		cfg.Timeout = *linkPreviewTimeout
+		cfg.CacheSize = *linkPreviewCacheSize
+		cfg.CacheTTL = *linkPreviewCacheTTL
+		previewer = linkpreview.NewPreviewer(logger, cfg)
+	}
+
+	accountMw := api.LoadAccount(logger, service)
+
+	// Streams are ended when the server starts shutting down, as Shutdown waits for every request to finish.
+	streamsDone := make(chan struct{})
+	stream := api.StreamConfig{
+		Heartbeat:    *streamHeartbeat,
+		WriteTimeout: writeTimeout,
+		Done:         streamsDone,
+	}
+
+	mux := api.NewHandler(logger, api.Deps{
+		Service:   service,
+		Tagger:    tagger,
+		TagQueue:  tagQueue,
+		Moderator: moderator,
+		Media:     mediaSvc,
+		Previewer: previewer,
+		Hub:       liveHub,
+		Stream:    stream,
+		Checks: map[string]api.HealthCheck{
+			"genai:tags":       ai.TagsCheck,
+			"genai:moderation": ai.ModerationCheck,
+		},
+	})
+
+	var handler http.Handler = authMw(accountMw(mux))
+	if *mediaStorage == "local" {
+		// Local media is served without authentication, as browsers do not send tokens when loading images.
+		root := http.NewServeMux()
+		root.Handle("/", handler)
+		root.Handle("GET /media/", http.StripPrefix("/media/", noDirListing(http.FileServer(http.Dir(*mediaLocalDir)))))
+		handler = root
+	}
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", *port),
-		Handler:      panicMw(loggingMw(corsMw(authMw(mux)))),
+		Handler:      panicMw(loggingMw(corsMw(handler))),
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: writeTimeout,
 		IdleTimeout:  120 * time.Second,
 	}
+	srv.RegisterOnShutdown(func() { close(streamsDone) })
 
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
@@ -106,4 +400,76 @@ func main() {
 		}
 		logger.Log("server gracefully shutdown", "addr", srv.Addr)
 	}
+
+	cancel()
+	background.Wait()
+}
+
+// btoi returns 1 if b is true, otherwise 0.
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// requirePositive returns an error naming the first of the given duration flags that is not positive.
+func requirePositive(flags *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if d, _ := flags.Lookup(name).Value.(flag.Getter).Get().(time.Duration); d <= 0 {
+			return fmt.Errorf("-%s must be positive", name)
+		}
+	}
+	return nil
+}
+
+// moderationThresholds applies the default thresholds to every category, then any overrides
+// given as category=quarantine:reject.
+func moderationThresholds(quarantine, reject float64, overrides string) (map[string]moderation.Threshold, error) {
+	thresholds := make(map[string]moderation.Threshold, len(genai.ModerationCategories))
+	for _, category := range genai.ModerationCategories {
+		thresholds[category] = moderation.Threshold{Quarantine: quarantine, Reject: reject}
+	}
+	for _, override := range splitList(overrides) {
+		category, values, ok := strings.Cut(override, "=")
+		q, r, ok2 := strings.Cut(values, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid threshold %q", override)
+		}
+		if _, ok := thresholds[category]; !ok {
+			return nil, fmt.Errorf("unknown moderation category %q", category)
+		}
+		qf, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quarantine threshold for %s: %w", category, err)
+		}
+		rf, err := strconv.ParseFloat(r, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reject threshold for %s: %w", category, err)
+		}
+		thresholds[category] = moderation.Threshold{Quarantine: qf, Reject: rf}
+	}
+	return thresholds, nil
+}
+
+// noDirListing responds not found for directories, so users' uploads cannot be enumerated.
+func noDirListing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,58 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCSStore is a Store in a Google Cloud Storage bucket, clients upload to it directly with signed URLs.
+type GCSStore struct {
+	bucket *storage.BucketHandle
+}
+
+func NewGCSStore(bucket *storage.BucketHandle) *GCSStore {
+	return &GCSStore{bucket: bucket}
+}
+
+func (s *GCSStore) UploadURL(ctx context.Context, key, contentType string, maxSize int64, expires time.Time) (string, map[string]string, error) {
+	// The length range header is signed, so GCS rejects uploads larger than allowed.
+	lengthRange := fmt.Sprintf("0,%d", maxSize)
+	url, err := s.bucket.SignedURL(key, &storage.SignedURLOptions{
+		Scheme:      storage.SigningSchemeV4,
+		Method:      http.MethodPut,
+		ContentType: contentType,
+		Headers:     []string{"x-goog-content-length-range:" + lengthRange},
+		Expires:     expires,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return url, map[string]string{
+		"Content-Type":                contentType,
+		"x-goog-content-length-range": lengthRange,
+	}, nil
+}
+
+func (s *GCSStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(key).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *GCSStore) Write(ctx context.Context, key, contentType string, r io.Reader) error {
+	w := s.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
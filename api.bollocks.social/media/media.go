@@ -0,0 +1,303 @@
+// Package media stores files uploaded by users and prepares them to be attached to posts.
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/gocore/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// metrics are published under "media" at the expvar endpoint.
+var metrics = expvar.NewMap("media")
+
+// maxPixels limits the dimensions of images decoded for thumbnails, so a small file
+// cannot claim a huge image and exhaust memory.
+const maxPixels = 50_000_000
+
+// uploadIDPattern matches the IDs generated by rand.Text.
+var uploadIDPattern = regexp.MustCompile(`^[A-Z2-7]{26}$`)
+
+var errTooLarge = errors.New("media: upload too large")
+
+type Config struct {
+	// BaseURL is joined with an object's key to form the URL clients fetch it from.
+	BaseURL string
+	// MaxSize is the largest file in bytes that may be uploaded.
+	MaxSize int64
+	// AllowedTypes are the content types that may be uploaded, checked against the file's content.
+	AllowedTypes []string
+	// ThumbnailSize is the width and height in pixels that image thumbnails fit within.
+	ThumbnailSize int
+	// UploadExpiry is how long an upload URL is valid for.
+	UploadExpiry time.Duration
+}
+
+// DefaultAllowedTypes are the image types thumbnails can be generated for.
+var DefaultAllowedTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// Media is an api.Media keeping uploads in a Store. Each user's uploads are kept under their own
+// key prefix, so users can only attach files they uploaded.
+//
+// Each upload is recorded in Uploads when it is created, so only recorded uploads that have not expired
+// are accepted. Files are copied when they are first attached to a key clients are never given a URL
+// to write to, so an attached file cannot be replaced through its upload URL.
+type Media struct {
+	logger  log.Logger
+	store   Store
+	uploads Uploads
+	cfg     Config
+}
+
+func NewMedia(logger log.Logger, store Store, uploads Uploads, cfg Config) *Media {
+	return &Media{
+		logger:  logger,
+		store:   store,
+		uploads: uploads,
+		cfg:     cfg,
+	}
+}
+
+func (m *Media) CreateUpload(ctx context.Context, contentType string, size int64) (*api.UploadTarget, error) {
+	if err := m.checkContentType(contentType); err != nil {
+		return nil, err
+	}
+	if size <= 0 || size > m.cfg.MaxSize {
+		return nil, status.Errorf(codes.InvalidArgument, "size must be between 1 and %d bytes", m.cfg.MaxSize)
+	}
+
+	id := rand.Text()
+	key, err := uploadKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(m.cfg.UploadExpiry)
+	userID, _ := api.ContextGetUserId(ctx)
+	if err := m.uploads.CreateUpload(ctx, userID, id, Upload{ContentType: contentType, ExpiresAt: expires}); err != nil {
+		return nil, err
+	}
+	url, headers, err := m.store.UploadURL(ctx, key, contentType, m.cfg.MaxSize, expires)
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		url, headers = "/uploads/"+id, map[string]string{"Content-Type": contentType}
+	}
+	metrics.Add("uploads", 1)
+	return &api.UploadTarget{
+		ID:        id,
+		URL:       url,
+		Method:    http.MethodPut,
+		Headers:   headers,
+		ExpiresAt: expires,
+	}, nil
+}
+
+func (m *Media) Upload(ctx context.Context, uploadID, contentType string, r io.Reader) error {
+	key, err := uploadKey(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	u, err := m.getUpload(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Attached:
+		return status.Errorf(codes.FailedPrecondition, "upload %s has already been attached", uploadID)
+	case time.Now().After(u.ExpiresAt):
+		return status.Errorf(codes.FailedPrecondition, "upload %s has expired", uploadID)
+	}
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	if contentType != u.ContentType {
+		return status.Errorf(codes.InvalidArgument, "content type must be %q", u.ContentType)
+	}
+	err = m.store.Write(ctx, key, contentType, &limitReader{r: r, n: m.cfg.MaxSize})
+	if errors.Is(err, errTooLarge) {
+		return status.Errorf(codes.ResourceExhausted, "upload is larger than %d bytes", m.cfg.MaxSize)
+	}
+	return err
+}
+
+func (m *Media) Attach(ctx context.Context, uploadID string) (*api.Attachment, error) {
+	key, err := uploadKey(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	u, err := m.getUpload(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	attachedKey := "media/" + strings.TrimPrefix(key, "uploads/")
+
+	// An upload is claimed once its file is valid, so only one request copies it.
+	// Uploads already attached, by this or a concurrent request, are read from their copy.
+	var data []byte
+	var contentType string
+	if !u.Attached {
+		data, contentType, err = m.read(ctx, uploadID, key)
+		if errors.Is(err, ErrNotFound) {
+			return nil, status.Errorf(codes.NotFound, "upload %s not found", uploadID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		userID, _ := api.ContextGetUserId(ctx)
+		claimed, err := m.uploads.SetUploadAttached(ctx, userID, uploadID, true)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			if err := m.store.Write(ctx, attachedKey, contentType, bytes.NewReader(data)); err != nil {
+				if _, releaseErr := m.uploads.SetUploadAttached(context.WithoutCancel(ctx), userID, uploadID, false); releaseErr != nil {
+					m.logger.Log("failed to release upload", "error", releaseErr, "upload_id", uploadID)
+				}
+				return nil, err
+			}
+			metrics.Add("copies", 1)
+		} else {
+			data = nil
+		}
+	}
+	if data == nil {
+		data, contentType, err = m.read(ctx, uploadID, attachedKey)
+		if errors.Is(err, ErrNotFound) {
+			return nil, status.Errorf(codes.FailedPrecondition, "upload %s is still being attached", uploadID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a := &api.Attachment{
+		ID:          uploadID,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		URL:         m.url(attachedKey),
+	}
+	if strings.HasPrefix(contentType, "image/") {
+		if err := m.setThumbnail(ctx, a, attachedKey, data); err != nil {
+			return nil, err
+		}
+	}
+	metrics.Add("attachments", 1)
+	return a, nil
+}
+
+// getUpload returns the record of an upload by the caller, failing with NotFound if they created no such upload.
+func (m *Media) getUpload(ctx context.Context, uploadID string) (*Upload, error) {
+	userID, _ := api.ContextGetUserId(ctx)
+	u, ok, err := m.uploads.GetUpload(ctx, userID, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "upload %s not found", uploadID)
+	}
+	return u, nil
+}
+
+// read returns the file stored at key and its content type, failing with InvalidArgument if it is too
+// large or not of an allowed type, and ErrNotFound if nothing is stored at key.
+func (m *Media) read(ctx context.Context, uploadID, key string) ([]byte, string, error) {
+	rc, err := m.store.Open(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, m.cfg.MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > m.cfg.MaxSize {
+		return nil, "", status.Errorf(codes.InvalidArgument, "upload %s is larger than %d bytes", uploadID, m.cfg.MaxSize)
+	}
+
+	// The declared content type is not trusted, the file must actually be of an allowed type.
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if err := m.checkContentType(contentType); err != nil {
+		return nil, "", err
+	}
+	return data, contentType, nil
+}
+
+// setThumbnail sets the dimensions of an image attachment and generates its thumbnail.
+// Images in formats that cannot be decoded are attached without a thumbnail.
+func (m *Media) setThumbnail(ctx context.Context, a *api.Attachment, key string, data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil || cfg.Width*cfg.Height > maxPixels {
+		return status.Errorf(codes.InvalidArgument, "upload %s is not a valid image", a.ID)
+	}
+	a.Width, a.Height = cfg.Width, cfg.Height
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "upload %s is not a valid image", a.ID)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail(img, m.cfg.ThumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return err
+	}
+	thumbKey := "thumbnails/" + strings.TrimPrefix(key, "media/") + ".jpg"
+	if err := m.store.Write(ctx, thumbKey, "image/jpeg", &buf); err != nil {
+		return err
+	}
+	metrics.Add("thumbnails", 1)
+	a.ThumbnailURL = m.url(thumbKey)
+	return nil
+}
+
+func (m *Media) checkContentType(contentType string) error {
+	if !slices.Contains(m.cfg.AllowedTypes, contentType) {
+		return status.Errorf(codes.InvalidArgument, "content type %q is not allowed", contentType)
+	}
+	return nil
+}
+
+func (m *Media) url(key string) string {
+	return strings.TrimSuffix(m.cfg.BaseURL, "/") + "/" + key
+}
+
+// uploadKey returns the key of an upload by the caller.
+func uploadKey(ctx context.Context, uploadID string) (string, error) {
+	if !uploadIDPattern.MatchString(uploadID) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid upload id %q", uploadID)
+	}
+	userID, _ := api.ContextGetUserId(ctx)
+	return "uploads/" + userID + "/" + uploadID, nil
+}
+
+// limitReader reads from r, failing with errTooLarge once more than n bytes have been read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,41 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when an object does not exist.
+var ErrNotFound = errors.New("media: object not found")
+
+// Store is blob storage for uploaded files, addressed by slash separated keys.
+type Store interface {
+	// UploadURL returns a URL, and the headers to send with it, that the client can PUT an object
+	// of at most maxSize bytes to until expires. The URL is empty if the store does not support
+	// direct uploads, in which case they are written through Media.Upload.
+	UploadURL(ctx context.Context, key, contentType string, maxSize int64, expires time.Time) (string, map[string]string, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Write(ctx context.Context, key, contentType string, r io.Reader) error
+}
+
+// Upload is the record of an upload, kept from when it is created.
+type Upload struct {
+	// ContentType is the type the upload was created for, files of other types are not accepted.
+	ContentType string
+	// ExpiresAt is when the upload stops accepting the file.
+	ExpiresAt time.Time
+	// Attached is set once the file has been copied to where attachments are served from,
+	// after which it is no longer accepted.
+	Attached bool
+}
+
+// Uploads records the uploads created by users, shared between instances.
+type Uploads interface {
+	CreateUpload(ctx context.Context, userID, uploadID string, upload Upload) error
+	// GetUpload returns an upload by a user, ok is false if they created no such upload.
+	GetUpload(ctx context.Context, userID, uploadID string) (upload *Upload, ok bool, err error)
+	// SetUploadAttached sets whether an upload by a user is attached, returning false if it already was.
+	SetUploadAttached(ctx context.Context, userID, uploadID string, attached bool) (bool, error)
+}
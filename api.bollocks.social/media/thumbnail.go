@@ -0,0 +1,36 @@
+package media
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// thumbnail scales img down, keeping its aspect ratio, to fit within size pixels square.
+// Transparent areas are filled white as thumbnails are encoded as JPEG.
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, max(h*size/w, 1)
+		} else {
+			tw, th = max(w*size/h, 1), size
+		}
+	}
+
+	// Nearest neighbour sampling is good enough at thumbnail sizes.
+	scaled := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := range th {
+		sy := b.Min.Y + y*h/th
+		for x := range tw {
+			scaled.Set(x, y, img.At(b.Min.X+x*w/tw, sy))
+		}
+	}
+
+	dst := image.NewRGBA(scaled.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), scaled, image.Point{}, draw.Over)
+	return dst
+}
@@ -0,0 +1,87 @@
+// Package moderation decides whether posts may be published based on content classification scores.
+package moderation
+
+import (
+	"context"
+	"expvar"
+	"slices"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// metrics are published under "moderation" at the expvar endpoint.
+var metrics = expvar.NewMap("moderation")
+
+// Classifier scores content from 0 to 1 per category.
+type Classifier interface {
+	Classify(ctx context.Context, content string) (map[string]float64, error)
+}
+
+// Threshold is the score at or above which content in a category is quarantined or rejected.
+// A zero threshold disables that action.
+type Threshold struct {
+	Quarantine float64
+	Reject     float64
+}
+
+type Config struct {
+	Thresholds map[string]Threshold
+	// FailClosed quarantines posts when classification fails, otherwise they are published unchecked.
+	FailClosed bool
+}
+
+// Moderator is an api.Moderator applying configured thresholds to classification scores.
+type Moderator struct {
+	logger     log.Logger
+	classifier Classifier
+	cfg        Config
+}
+
+func NewModerator(logger log.Logger, classifier Classifier, cfg Config) *Moderator {
+	return &Moderator{
+		logger:     logger,
+		classifier: classifier,
+		cfg:        cfg,
+	}
+}
+
+func (m *Moderator) Moderate(ctx context.Context, content string) (*api.Moderation, error) {
+	now := time.Now()
+	scores, err := m.classifier.Classify(ctx, content)
+	if err != nil {
+		m.logger.Log("failed to classify content", "error", err)
+		metrics.Add("errors", 1)
+		decision := api.ModerationUnchecked
+		if m.cfg.FailClosed {
+			decision = api.ModerationQuarantined
+		}
+		metrics.Add(decision, 1)
+		return &api.Moderation{Decision: decision, CheckedAt: now}, nil
+	}
+
+	verdict := &api.Moderation{Decision: api.ModerationApproved, Scores: scores, CheckedAt: now}
+	var worst float64
+	// Categories are visited in order so the reason is deterministic when scores tie.
+	categories := make([]string, 0, len(m.cfg.Thresholds))
+	for category := range m.cfg.Thresholds {
+		categories = append(categories, category)
+	}
+	slices.Sort(categories)
+	for _, category := range categories {
+		threshold, score := m.cfg.Thresholds[category], scores[category]
+		switch {
+		case threshold.Reject > 0 && score >= threshold.Reject:
+			if verdict.Decision != api.ModerationRejected || score > worst {
+				verdict.Decision, verdict.Reason, worst = api.ModerationRejected, category, score
+			}
+		case threshold.Quarantine > 0 && score >= threshold.Quarantine:
+			if verdict.Decision == api.ModerationApproved || (verdict.Decision == api.ModerationQuarantined && score > worst) {
+				verdict.Decision, verdict.Reason, worst = api.ModerationQuarantined, category, score
+			}
+		}
+	}
+	metrics.Add(verdict.Decision, 1)
+	return verdict, nil
+}
@@ -0,0 +1,76 @@
+// Package purging permanently removes soft-deleted posts and finished webhook deliveries once their retention periods have passed.
+package purging
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/batching"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// metrics are published under "purger" at the expvar endpoint.
+var metrics = expvar.NewMap("purger")
+
+// Store permanently removes deleted posts and finished webhook deliveries.
+type Store interface {
+	// PurgeDeletedPosts removes up to limit posts deleted before the given time, returning the number removed.
+	PurgeDeletedPosts(ctx context.Context, before time.Time, limit int) (int, error)
+	// PurgeWebhookDeliveries removes up to limit deliveries finished before the given time, returning the number removed.
+	PurgeWebhookDeliveries(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+type Config struct {
+	// Retention is how long deleted posts are kept before they are purged, zero to keep them.
+	Retention time.Duration
+	// DeliveryRetention is how long finished webhook deliveries are kept before they are purged, zero to keep them.
+	DeliveryRetention time.Duration
+	// Interval is how often deleted posts and finished deliveries are purged.
+	Interval time.Duration
+	// BatchSize is the number of posts or deliveries purged per query, batches are repeated until none remain.
+	BatchSize int
+}
+
+// Purger periodically removes deleted posts and finished webhook deliveries older than their retention periods.
+type Purger struct {
+	logger log.Logger
+	store  Store
+	cfg    Config
+}
+
+func NewPurger(logger log.Logger, store Store, cfg Config) *Purger {
+	return &Purger{
+		logger: logger,
+		store:  store,
+		cfg:    cfg,
+	}
+}
+
+// Run purges deleted posts and finished deliveries every interval until ctx is cancelled.
+func (p *Purger) Run(ctx context.Context) {
+	batching.Every(ctx, p.cfg.Interval, p.purge)
+}
+
+func (p *Purger) purge(ctx context.Context) {
+	if p.cfg.Retention > 0 {
+		p.purgeBatches(ctx, "posts", p.cfg.Retention, p.store.PurgeDeletedPosts)
+	}
+	if p.cfg.DeliveryRetention > 0 {
+		p.purgeBatches(ctx, "deliveries", p.cfg.DeliveryRetention, p.store.PurgeWebhookDeliveries)
+	}
+}
+
+// purgeBatches calls purge with batches of what is older than retention until none remain.
+func (p *Purger) purgeBatches(ctx context.Context, what string, retention time.Duration, purge func(ctx context.Context, before time.Time, limit int) (int, error)) {
+	before := time.Now().Add(-retention)
+	err := batching.Drain(ctx, p.cfg.BatchSize, func(ctx context.Context, limit int) (int, error) {
+		n, err := purge(ctx, before, limit)
+		metrics.Add("purged_"+what, int64(n))
+		return n, err
+	})
+	if err != nil && ctx.Err() == nil {
+		metrics.Add("errors", 1)
+		p.logger.Log("failed to purge "+what, "error", err)
+	}
+}
@@ -0,0 +1,60 @@
+// Package scheduling publishes scheduled posts once they are due.
+package scheduling
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/batching"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// metrics are published under "scheduler" at the expvar endpoint.
+var metrics = expvar.NewMap("scheduler")
+
+// Store publishes scheduled posts.
+type Store interface {
+	// PublishDuePosts publishes up to limit posts due at or before now, returning the number published.
+	PublishDuePosts(ctx context.Context, now time.Time, limit int) (int, error)
+}
+
+type Config struct {
+	// Interval is how often due posts are published, and so the most a post is published late by.
+	Interval time.Duration
+	// BatchSize is the number of posts published per query, batches are repeated until none remain.
+	BatchSize int
+}
+
+// Scheduler periodically publishes scheduled posts that are due.
+type Scheduler struct {
+	logger log.Logger
+	store  Store
+	cfg    Config
+}
+
+func NewScheduler(logger log.Logger, store Store, cfg Config) *Scheduler {
+	return &Scheduler{
+		logger: logger,
+		store:  store,
+		cfg:    cfg,
+	}
+}
+
+// Run publishes due posts every interval until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	batching.Every(ctx, s.cfg.Interval, s.publish)
+}
+
+func (s *Scheduler) publish(ctx context.Context) {
+	now := time.Now()
+	err := batching.Drain(ctx, s.cfg.BatchSize, func(ctx context.Context, limit int) (int, error) {
+		n, err := s.store.PublishDuePosts(ctx, now, limit)
+		metrics.Add("published", int64(n))
+		return n, err
+	})
+	if err != nil && ctx.Err() == nil {
+		metrics.Add("errors", 1)
+		s.logger.Log("failed to publish scheduled posts", "error", err)
+	}
+}
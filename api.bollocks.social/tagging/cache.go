@@ -0,0 +1,163 @@
+package tagging
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// cacheMetrics are published under "tag_cache" at the expvar endpoint.
+var cacheMetrics = expvar.NewMap("tag_cache")
+
+// CacheStore is a persistent second tier for cached tags, shared between instances.
+type CacheStore interface {
+	// GetCachedTags returns the tags cached under key, ok is false unless they were cached at or after since.
+	GetCachedTags(ctx context.Context, key string, since time.Time) (tags []string, ok bool, err error)
+	SetCachedTags(ctx context.Context, key string, tags []string) error
+}
+
+type CacheConfig struct {
+	// Size is the number of results held in memory.
+	Size int
+	// TTL is how long results are reused for, zero to reuse them until they are evicted.
+	TTL time.Duration
+	// Version identifies the model and prompt the tagger generates tags with. It is part of every key,
+	// so tags generated under a different configuration are not reused.
+	Version string
+}
+
+// Cache is a Tagger that remembers the tags generated for content, so unchanged edits
+// and identical reposts are not re-tagged. Only successful results are cached.
+type Cache struct {
+	logger log.Logger
+	tagger api.Tagger
+	// store is optional.
+	store CacheStore
+	cfg   CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key       string
+	tags      []string
+	createdAt time.Time
+}
+
+// NewCache returns a Tagger holding up to cfg.Size results in memory in front of tagger.
+// store may be nil to only cache in memory.
+func NewCache(logger log.Logger, tagger api.Tagger, store CacheStore, cfg CacheConfig) *Cache {
+	return &Cache{
+		logger:  logger,
+		tagger:  tagger,
+		store:   store,
+		cfg:     cfg,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *Cache) GenerateTags(ctx context.Context, content string) ([]string, error) {
+	key := c.key(content)
+	if tags, ok := c.get(key); ok {
+		cacheMetrics.Add("hits", 1)
+		return tags, nil
+	}
+
+	if c.store != nil {
+		tags, ok, err := c.store.GetCachedTags(ctx, key, c.since())
+		if err != nil {
+			cacheMetrics.Add("store_errors", 1)
+			c.logger.Log("failed to get cached tags", "error", err, "key", key)
+		}
+		if ok {
+			cacheMetrics.Add("store_hits", 1)
+			c.add(key, tags)
+			return tags, nil
+		}
+	}
+
+	cacheMetrics.Add("misses", 1)
+	tags, err := c.tagger.GenerateTags(ctx, content)
+	if err != nil {
+		return nil, err
+	}
+
+	c.add(key, tags)
+	if c.store != nil {
+		if err := c.store.SetCachedTags(ctx, key, tags); err != nil {
+			cacheMetrics.Add("store_errors", 1)
+			c.logger.Log("failed to cache tags", "error", err, "key", key)
+		}
+	}
+	return tags, nil
+}
+
+// get returns a copy of the tags cached for key, so the caller may modify them.
+func (c *Cache) get(key string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if e.Value.(*cacheEntry).createdAt.Before(c.since()) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return slices.Clone(e.Value.(*cacheEntry).tags), true
+}
+
+// add caches a copy of tags, so the caller may go on to modify the slice it returns.
+func (c *Cache) add(key string, tags []string) {
+	tags = slices.Clone(tags)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).tags = tags
+		e.Value.(*cacheEntry).createdAt = now
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, tags: tags, createdAt: now})
+	for c.lru.Len() > c.cfg.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// since returns the time results must have been cached after to be reused.
+func (c *Cache) since() time.Time {
+	if c.cfg.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-c.cfg.TTL)
+}
+
+// key returns the key content's tags are cached under, a hex SHA-256 of the version and the content's hash.
+func (c *Cache) key(content string) string {
+	sum := sha256.Sum256([]byte(c.cfg.Version + ":" + ContentHash(content)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ContentHash returns a hex SHA-256 of content normalized for case and whitespace.
+func ContentHash(content string) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(content)), " ")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,149 @@
+// Package tagging enriches posts with AI generated tags in the background.
+package tagging
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/batching"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/genai"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// Store persists tags generated for a post.
+type Store interface {
+	// SetPostTags stores tags for a post and marks them complete, provided its content has not changed since the job was queued.
+	SetPostTags(ctx context.Context, postID, content string, tags []string) error
+	// PendingTagPosts returns up to limit posts whose tags are still pending.
+	PendingTagPosts(ctx context.Context, limit int) ([]api.Post, error)
+}
+
+type Config struct {
+	Workers int
+	Size    int
+	// PollInterval is how often the store is polled for pending posts, picking up
+	// jobs lost to a restart or a full queue. 0 keeps the queue purely in-process.
+	PollInterval time.Duration
+}
+
+// Queue generates tags for posts on a pool of background workers.
+type Queue struct {
+	logger log.Logger
+	tagger api.Tagger
+	store  Store
+	cfg    Config
+	jobs   chan string
+
+	mu sync.Mutex
+	// pending holds the latest content to tag for each queued post ID.
+	pending map[string]string
+	// inFlight holds the IDs of posts being tagged by a worker.
+	inFlight map[string]bool
+}
+
+func NewQueue(logger log.Logger, tagger api.Tagger, store Store, cfg Config) *Queue {
+	return &Queue{
+		logger:   logger,
+		tagger:   tagger,
+		store:    store,
+		cfg:      cfg,
+		jobs:     make(chan string, cfg.Size),
+		pending:  make(map[string]string),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// Enqueue schedules tag generation for a post without blocking.
+// If the post is already queued its content is replaced so only the latest edit is tagged.
+// It returns false if the queue is full.
+func (q *Queue) Enqueue(postID, content string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.enqueue(postID, content)
+}
+
+// enqueue is Enqueue with q.mu held.
+func (q *Queue) enqueue(postID, content string) bool {
+	if _, ok := q.pending[postID]; ok {
+		q.pending[postID] = content
+		return true
+	}
+	select {
+	case q.jobs <- postID:
+		q.pending[postID] = content
+		return true
+	default:
+		return false
+	}
+}
+
+// Run processes jobs until ctx is cancelled and all workers have returned.
+// Jobs still queued at shutdown remain pending in the store.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range max(q.cfg.Workers, 1) {
+		wg.Go(func() { q.work(ctx) })
+	}
+	if q.cfg.PollInterval > 0 {
+		wg.Go(func() { batching.Every(ctx, q.cfg.PollInterval, q.poll) })
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case postID := <-q.jobs:
+			q.mu.Lock()
+			content := q.pending[postID]
+			delete(q.pending, postID)
+			q.inFlight[postID] = true
+			q.mu.Unlock()
+			q.process(ctx, postID, content)
+			q.mu.Lock()
+			delete(q.inFlight, postID)
+			q.mu.Unlock()
+		}
+	}
+}
+
+func (q *Queue) process(ctx context.Context, postID, content string) {
+	tags, err := q.tagger.GenerateTags(ctx, content)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		q.logger.Log("failed to generate AI tags, falling back", "error", err, "post_id", postID)
+		tags = genai.Hashtags(content)
+	}
+
+	if err := q.store.SetPostTags(ctx, postID, content, tags); err != nil {
+		q.logger.Log("failed to set post tags", "error", err, "post_id", postID)
+	}
+}
+
+func (q *Queue) poll(ctx context.Context) {
+	posts, err := q.store.PendingTagPosts(ctx, q.cfg.Size)
+	if err != nil && ctx.Err() == nil {
+		q.logger.Log("failed to get posts pending tags", "error", err)
+	}
+	q.enqueuePolled(posts)
+}
+
+// enqueuePolled queues posts found pending in the store, other than those being tagged, which are
+// still pending until their worker stores their tags. Posts already queued keep their queued content,
+// which is at least as recent as what was polled.
+func (q *Queue) enqueuePolled(posts []api.Post) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, p := range posts {
+		if _, ok := q.pending[p.ID]; ok || q.inFlight[p.ID] {
+			continue
+		}
+		q.enqueue(p.ID, p.Bollocks)
+	}
+}
@@ -0,0 +1,191 @@
+// Package webhooks delivers events to the endpoints registered by users and admins, signing each with
+// the webhook's secret and retrying failed deliveries with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mchipperfield/bollocks/api.bollocks.social/api"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/batching"
+	"github.com/mchipperfield/bollocks/api.bollocks.social/publichttp"
+	"github.com/mchipperfield/gocore/log"
+)
+
+// metrics are published under "webhooks" at the expvar endpoint.
+var metrics = expvar.NewMap("webhooks")
+
+const (
+	// SignatureHeader holds the signature of a delivery, see Sign.
+	SignatureHeader = "X-Bollocks-Signature"
+	EventHeader     = "X-Bollocks-Event"
+	DeliveryHeader  = "X-Bollocks-Delivery"
+)
+
+// Store queues deliveries and records the attempts to make them.
+type Store interface {
+	// ClaimWebhookDeliveries returns up to limit deliveries due by now, postponing them by lease so they are not delivered twice.
+	ClaimWebhookDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]api.WebhookDelivery, error)
+	// RecordWebhookAttempt logs an attempt to deliver and sets the delivery's status, a pending delivery is next attempted at next.
+	RecordWebhookAttempt(ctx context.Context, deliveryID string, attempt api.WebhookAttempt, status string, next time.Time) error
+}
+
+type Config struct {
+	// Interval is how often due deliveries are made.
+	Interval time.Duration
+	// BatchSize is the number of deliveries made at once, batches are repeated until none are due.
+	BatchSize int
+	// Timeout bounds each attempt, endpoints must respond within it.
+	Timeout time.Duration
+	// MaxAttempts is the number of attempts made before a delivery fails.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled for each retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	UserAgent  string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:    10 * time.Second,
+		BatchSize:   20,
+		Timeout:     10 * time.Second,
+		MaxAttempts: 8,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  6 * time.Hour,
+		UserAgent:   "bollocks.social-webhooks/1.0",
+	}
+}
+
+// Deliverer periodically delivers the events queued for webhooks.
+type Deliverer struct {
+	logger log.Logger
+	store  Store
+	client *http.Client
+	cfg    Config
+}
+
+func NewDeliverer(logger log.Logger, store Store, cfg Config) *Deliverer {
+	return &Deliverer{
+		logger: logger,
+		store:  store,
+		// Redirects are not followed, a webhook must be registered with the URL that accepts deliveries.
+		client: publichttp.NewClient(cfg.Timeout, 0),
+		cfg:    cfg,
+	}
+}
+
+// Run makes due deliveries every interval until ctx is cancelled.
+func (d *Deliverer) Run(ctx context.Context) {
+	batching.Every(ctx, d.cfg.Interval, d.deliverDue)
+}
+
+func (d *Deliverer) deliverDue(ctx context.Context) {
+	// Deliveries are leased for long enough to attempt them all.
+	lease := 2 * d.cfg.Timeout
+	err := batching.Drain(ctx, d.cfg.BatchSize, func(ctx context.Context, limit int) (int, error) {
+		deliveries, err := d.store.ClaimWebhookDeliveries(ctx, time.Now(), lease, limit)
+		if err != nil {
+			return 0, err
+		}
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Go(func() { d.deliver(ctx, delivery) })
+		}
+		wg.Wait()
+		return len(deliveries), nil
+	})
+	if err != nil && ctx.Err() == nil {
+		metrics.Add("errors", 1)
+		d.logger.Log("failed to claim webhook deliveries", "error", err)
+	}
+}
+
+func (d *Deliverer) deliver(ctx context.Context, delivery api.WebhookDelivery) {
+	attempt := api.WebhookAttempt{Attempt: delivery.Attempts + 1, At: time.Now()}
+	statusCode, err := d.post(ctx, delivery, attempt.At)
+	attempt.StatusCode = statusCode
+	attempt.DurationMS = time.Since(attempt.At).Milliseconds()
+	metrics.Add("attempts", 1)
+
+	status, next := api.DeliveryStatusSucceeded, time.Time{}
+	switch {
+	case err == nil:
+		metrics.Add("delivered", 1)
+	case attempt.Attempt >= d.cfg.MaxAttempts:
+		attempt.Error = err.Error()
+		status = api.DeliveryStatusFailed
+		metrics.Add("failed", 1)
+	default:
+		attempt.Error = err.Error()
+		status, next = api.DeliveryStatusPending, time.Now().Add(d.backoff(attempt.Attempt))
+		metrics.Add("retries", 1)
+	}
+
+	if err := d.store.RecordWebhookAttempt(ctx, delivery.ID, attempt, status, next); err != nil && ctx.Err() == nil {
+		// The delivery is attempted again once its lease expires.
+		metrics.Add("errors", 1)
+		d.logger.Log("failed to record webhook attempt", "error", err, "delivery_id", delivery.ID)
+	}
+}
+
+// post sends a delivery to its webhook, returning the status code of the response if there is one.
+// Any status other than 2xx is a failure.
+func (d *Deliverer) post(ctx context.Context, delivery api.WebhookDelivery, at time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", d.cfg.UserAgent)
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, at, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Draining a little of the body lets the connection be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the wait after the given attempt, with jitter so retries to a failing endpoint spread out.
+func (d *Deliverer) backoff(attempt int) time.Duration {
+	wait := d.cfg.Backoff
+	for range attempt - 1 {
+		wait *= 2
+		if wait >= d.cfg.MaxBackoff {
+			wait = d.cfg.MaxBackoff
+			break
+		}
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// Sign returns the signature of a payload sent at t, as "t=<unix time>,v1=<signature>" where the signature
+// is the hex encoded HMAC-SHA256 of "<unix time>.<payload>" keyed by the webhook's secret. Receivers
+// should compare it in constant time and reject old timestamps so deliveries cannot be replayed.
+func Sign(secret string, t time.Time, payload []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}